@@ -3,7 +3,13 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // the image has no zoneinfo, chat timezones need it
 
 	"cloud.google.com/go/vertexai/genai"
 	"github.com/getsentry/sentry-go"
@@ -13,8 +19,8 @@ import (
 	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
 	"github.com/shabablinchikow/nafanya-bot/internal/domain"
 	"github.com/shabablinchikow/nafanya-bot/internal/tghandler"
-	genaisdk "google.golang.org/genai"
 	"google.golang.org/api/option"
+	genaisdk "google.golang.org/genai"
 	"gorm.io/gorm"
 	"gorm.io/gorm/schema"
 )
@@ -24,6 +30,9 @@ func main() {
 	// Load the config from the environment variables
 	config := cfg.LoadConfig()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	var env string
 	if config.DebugMode {
 		env = "development"
@@ -45,12 +54,14 @@ func main() {
 	defer sentry.Recover()
 	defer sentry.Flush(2 * time.Second)
 
-	aiOAI := openai.NewClient(config.OAIToken)
+	oaiAccount := aihandler.OpenAIAccount{BaseURL: config.OAIBaseURL, APIKey: config.OAIToken}
+	aiOAI := oaiAccount.Client()
 	var dsAI *openai.Client
 
 	if config.DSToken != "" {
 		config := openai.DefaultConfig(config.DSToken)
 		config.BaseURL = "https://api.deepseek.com"
+		config.HTTPClient = aihandler.NewHTTPClient()
 		dsAI = openai.NewClientWithConfig(config)
 	}
 	aiGoogle, err2 := genai.NewClient(context.Background(), "gnomed-1695577860628", "europe-west4", option.WithCredentialsJSON([]byte(config.GoogleToken)))
@@ -62,8 +73,9 @@ func main() {
 	var geminiDirect *genaisdk.Client
 	if config.GeminiDirectKey != "" {
 		geminiDirect, err2 = genaisdk.NewClient(context.Background(), &genaisdk.ClientConfig{
-			APIKey:  config.GeminiDirectKey,
-			Backend: genaisdk.BackendGeminiAPI,
+			APIKey:     config.GeminiDirectKey,
+			Backend:    genaisdk.BackendGeminiAPI,
+			HTTPClient: aihandler.NewHTTPClient(),
 		})
 		if err2 != nil {
 			sentry.CaptureException(err2)
@@ -71,7 +83,17 @@ func main() {
 		}
 	}
 
-	aiHndlr := aihandler.NewHandler(aiOAI, aiGoogle, dsAI, geminiDirect)
+	aiHndlr := aihandler.NewHandler(aihandler.Clients{
+		OpenAI:   aiOAI,
+		DeepSeek: dsAI,
+		Vertex:   aiGoogle,
+		Gemini:   geminiDirect,
+
+		OpenAIAccount: oaiAccount,
+	})
+	if config.Transcriber == "gemini" {
+		aiHndlr.SetTranscriber(aihandler.NewGeminiTranscriber(geminiDirect))
+	}
 
 	dbDSN := "host=" + config.DBHost + " user=" + config.DBUser + " password=" + config.DBPass + " dbname=" + config.DBName + " port=" + config.DBPort + " sslmode=" + config.DBSSL
 	dbConfig := &gorm.Config{
@@ -86,7 +108,11 @@ func main() {
 		log.Panic(err)
 	}
 
-	bot, err2 := tgbotapi.NewBotAPI(config.BotToken)
+	endpoint := config.BotAPIEndpoint
+	if endpoint == "" {
+		endpoint = tgbotapi.APIEndpoint
+	}
+	bot, err2 := tgbotapi.NewBotAPIWithAPIEndpoint(config.BotToken, endpoint)
 	if err2 != nil {
 		sentry.CaptureException(err2)
 		log.Panic(err2)
@@ -96,14 +122,73 @@ func main() {
 
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	// the model calls outlive ctx for the shutdown grace period, work is cancelled when it is over
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	handler := tghandler.NewHandler(work, bot, aiHndlr, db)
+	handler.SetTimeouts(config.TextTimeout, config.ImageTimeout)
+	handler.SetPlans(config.StarPlans)
+	handler.SetReminders(config.Reminders)
+	handler.SetTrialDays(config.TrialDays)
+	handler.SetLimits(config.Limits)
+	handler.SetMessageRetention(config.MessageRetention)
+	if err := handler.LoadModels(config.ModelCatalog); err != nil {
+		sentry.CaptureException(err)
+		log.Panic(err)
+	}
+
+	go handler.RunReminders(ctx)
+	go handler.RunLimitCleanup(ctx)
+	go handler.RunHistoryCleanup(ctx)
+
+	ready := &atomic.Bool{}
+	var webhook http.Handler
+	if config.WebhookURL != "" {
+		webhook = handler.Webhook(config.WebhookSecret)
+	}
+	server := startServer(config.HTTPPort, ready, webhookPath(config.WebhookURL), webhook)
+
+	if config.WebhookURL != "" {
+		if err := handler.SetWebhook(config.WebhookURL, config.WebhookSecret, config.AllowedUpdates); err != nil {
+			sentry.CaptureException(err)
+			log.Panic(err)
+		}
+		log.Println("Receiving updates at", config.WebhookURL)
+		ready.Store(true)
+		// the webhook stays set on shutdown, the next instance gets the updates Telegram keeps meanwhile
+		<-ctx.Done()
+	} else {
+		// getUpdates is refused while a webhook is set, this switches a bot back from the webhook mode
+		if err := handler.DeleteWebhook(); err != nil {
+			sentry.CaptureException(err)
+			log.Panic(err)
+		}
+		log.Println("Receiving updates by long polling")
+		ready.Store(true)
+		pollUpdates(ctx, bot, handler, config.AllowedUpdates)
+	}
 
-	updates := bot.GetUpdatesChan(u)
+	log.Println("Shutting down")
+	ready.Store(false)
 
-	handler := tghandler.NewHandler(bot, aiHndlr, db)
+	grace, cancelGrace := context.WithTimeout(context.Background(), config.ShutdownGrace)
+	defer cancelGrace()
+	// the webhook requests in progress hand their updates to the handler before it is waited for
+	if err := server.Shutdown(grace); err != nil {
+		log.Println(err)
+	}
+	if !handler.Wait(grace) {
+		log.Println("Grace period is over, cancelling the answers being generated")
+		cancelWork()
+		// cancelled calls return at once, the handlers only send the partial answers
+		cancelled, cancelCancelled := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelCancelled()
+		handler.Wait(cancelled)
+	}
 
-	for update := range updates {
-		go handler.HandleEvents(update)
+	if err := db.Close(); err != nil {
+		log.Println(err)
 	}
+	log.Println("Stopped")
 }
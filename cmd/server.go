@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/tghandler"
+)
+
+// startServer serves the health probes and the webhook if it is given. The bot is ready while ready is true,
+// it is live as long as the process answers.
+func startServer(port string, ready *atomic.Bool, webhookPath string, webhook http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	if webhook != nil {
+		mux.Handle(webhookPath, webhook)
+	}
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sentry.CaptureException(err)
+			log.Println("HTTP server stopped:", err)
+		}
+	}()
+
+	return server
+}
+
+// webhookPath is the path of the webhook URL the server listens at, "/" if the URL has none
+func webhookPath(webhookURL string) string {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || parsed.Path == "" {
+		return "/"
+	}
+	return parsed.Path
+}
+
+// pollUpdates passes the updates to the handler until ctx is done
+func pollUpdates(ctx context.Context, bot *tgbotapi.BotAPI, handler *tghandler.Handler, allowedUpdates []string) {
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	u.AllowedUpdates = allowedUpdates
+
+	updates := bot.GetUpdatesChan(u)
+
+receive:
+	for {
+		select {
+		case <-ctx.Done():
+			break receive
+		case update := <-updates:
+			handler.Handle(update)
+		}
+	}
+
+	bot.StopReceivingUpdates()
+	// the poll in progress confirms the updates fetched already to Telegram, dropping them would lose them
+	for drained := false; !drained; {
+		select {
+		case update, ok := <-updates:
+			if ok {
+				handler.Handle(update)
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+}
@@ -5,214 +5,118 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
-	"strings"
 
 	"cloud.google.com/go/vertexai/genai"
 	"github.com/getsentry/sentry-go"
-	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
 	"github.com/sashabaranov/go-openai"
 	genaisdk "google.golang.org/genai"
-	"mvdan.cc/xurls/v2"
 )
 
 type Handler struct {
 	aiOAI        *openai.Client
-	deepSeek     *openai.Client
-	aiGoogle     *genai.Client
 	geminiDirect *genaisdk.Client
+	clients      Clients
+	transcriber  Transcriber
+	oaiAccount   OpenAIAccount
+	providers    *Registry
 }
 
-func NewHandler(oai *openai.Client, googleAI *genai.Client, deep *openai.Client, geminiDirect *genaisdk.Client) *Handler {
-	return &Handler{
-		aiOAI:        oai,
-		aiGoogle:     googleAI,
-		deepSeek:     deep,
-		geminiDirect: geminiDirect,
-	}
-}
+// Clients are the API clients of the backends, nil means the backend is not configured
+type Clients struct {
+	OpenAI   *openai.Client
+	DeepSeek *openai.Client
+	Vertex   *genai.Client
+	Gemini   *genaisdk.Client
 
-func (h *Handler) GetPromptResponse(prompt string, userInput string, model string, maxTokens int) (string, error) {
-	switch model {
-	case string(cfg.AIModelGPT55):
-		return h.GetPromptResponseOAI(prompt, userInput, maxTokens)
-	case string(cfg.AIModelDeepSeekV4):
-		return h.GetPromptResponseDS(prompt, userInput, maxTokens)
-	case string(cfg.AIModelGemini35):
-		return h.GetPromptResponseGoogle(prompt, userInput, maxTokens)
-	}
-
-	return "", fmt.Errorf("unknown model: %s", model)
+	OpenAIAccount OpenAIAccount // the account OpenAI was made from, for the requests the client can not make
 }
 
-func (h *Handler) GetPromptResponseOAI(prompt string, userInput string, maxTokens int) (string, error) {
-	// gpt-5.5 rejects max_tokens and requires max_completion_tokens
-	return h.GetPromptResponseOAICommon(h.aiOAI, prompt, userInput, maxTokens, cfg.GetAIModelBackendName(cfg.AIModelGPT55), true)
+// NewHandler creates the handler with the backend clients, text models are added
+// with ApplyCatalog or RegisterProvider
+func NewHandler(clients Clients) *Handler {
+	return &Handler{
+		aiOAI:        clients.OpenAI,
+		geminiDirect: clients.Gemini,
+		clients:      clients,
+		transcriber:  NewOAITranscriber(clients.OpenAI),
+		oaiAccount:   clients.OpenAIAccount,
+		providers:    NewRegistry(),
+	}
 }
 
-func (h *Handler) GetPromptResponseDS(prompt string, userInput string, maxTokens int) (string, error) {
-	return h.GetPromptResponseOAICommon(h.deepSeek, prompt, userInput, maxTokens, cfg.GetAIModelBackendName(cfg.AIModelDeepSeekV4), false)
+func (h *Handler) GetPromptResponse(ctx context.Context, prompt string, userInput string, model string, maxTokens int) (string, error) {
+	return h.GetChatResponse(ctx, NewRequest(prompt, userInput, model, maxTokens))
 }
 
-func (h *Handler) GetPromptResponseOAICommon(client *openai.Client, prompt string, userInput string, maxTokens int, model string, useCompletionTokens bool) (string, error) {
-	if client == nil {
-		return "", fmt.Errorf("model not available")
-	}
-	messages := make([]openai.ChatCompletionMessage, 0)
-	messages = append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: prompt,
-	})
-
-	messages = append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: userInput,
-	})
-
-	req := openai.ChatCompletionRequest{
-		Model:    model,
-		Messages: messages,
-	}
-	if useCompletionTokens {
-		req.MaxCompletionTokens = maxTokens
-	} else {
-		req.MaxTokens = maxTokens
-	}
-
-	resp, err := client.CreateChatCompletion(context.Background(), req)
+// GetChatResponse sends the multi-turn request to the model selected in req.Model
+func (h *Handler) GetChatResponse(ctx context.Context, req Request) (string, error) {
+	provider, err := h.provider(req)
 	if err != nil {
-		sentry.CaptureException(err)
-		log.Println("Completion error:", err)
-		return "", err
-	}
-
-	if len(resp.Choices) == 0 {
-		err := fmt.Errorf("no choices returned from API")
-		sentry.CaptureException(err)
 		return "", err
 	}
 
-	return resp.Choices[0].Message.Content, nil
+	return provider.Generate(ctx, req)
 }
-func (h *Handler) GetPromptResponseGoogle(prompt string, userInput string, maxTokens int) (string, error) {
-	if h.geminiDirect != nil {
-		return h.getPromptResponseGeminiDirect(prompt, userInput, maxTokens)
-	}
-	return h.getPromptResponseVertexAI(prompt, userInput, maxTokens)
-}
-
-const geminiRetries = 3
 
-// extractYouTubeURLs finds YouTube URLs in userInput, returns them and the cleaned text.
-func extractYouTubeURLs(userInput string) ([]string, string) {
-	rxRelaxed := xurls.Relaxed()
-	allURLs := rxRelaxed.FindAllString(userInput, -1)
-	remaining := userInput
-	var ytURLs []string
-	for _, u := range allURLs {
-		if strings.Contains(u, "youtube.com") || strings.Contains(u, "youtu.be") {
-			ytURLs = append(ytURLs, u)
-			remaining = strings.ReplaceAll(remaining, u, "")
-		}
+// provider finds the provider of the request model and checks it can handle the request
+func (h *Handler) provider(req Request) (TextProvider, error) {
+	provider, err := h.providers.Get(req.Model)
+	if err != nil {
+		return nil, err
 	}
-	return ytURLs, strings.TrimSpace(remaining)
-}
 
-func (h *Handler) getPromptResponseGeminiDirect(prompt string, userInput string, _ int) (string, error) {
-
-	geminiCfg := &genaisdk.GenerateContentConfig{
-		SystemInstruction: genaisdk.NewContentFromText(prompt, "user"),
-		SafetySettings: []*genaisdk.SafetySetting{
-			{Category: genaisdk.HarmCategoryHarassment, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
-			{Category: genaisdk.HarmCategoryHateSpeech, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
-			{Category: genaisdk.HarmCategorySexuallyExplicit, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
-			{Category: genaisdk.HarmCategoryDangerousContent, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
-		},
+	caps := provider.Capabilities()
+	if req.HasImages() && !caps.Vision {
+		return nil, fmt.Errorf("model %s does not support images", req.Model)
 	}
-
-	ytURLs, cleanedInput := extractYouTubeURLs(userInput)
-	parts := make([]*genaisdk.Part, 0, len(ytURLs)+1)
-	for _, u := range ytURLs {
-		parts = append(parts, genaisdk.NewPartFromURI(u, "video/mp4"))
+	if len(req.Tools) > 0 && !caps.Tools {
+		return nil, fmt.Errorf("model %s does not support tools", req.Model)
 	}
-	parts = append(parts, genaisdk.NewPartFromText(cleanedInput))
-	contents := []*genaisdk.Content{genaisdk.NewContentFromParts(parts, "user")}
 
-	var lastErr error
-	for i := range geminiRetries {
-		resp, err := h.geminiDirect.Models.GenerateContent(
-			context.Background(),
-			cfg.GetAIModelBackendName(cfg.AIModelGemini35),
-			contents,
-			geminiCfg,
-		)
-		if err != nil {
-			log.Printf("Gemini attempt %d error: %v", i+1, err)
-			lastErr = err
-			continue
-		}
-		return resp.Text(), nil
-	}
-	return "", lastErr
+	return provider, nil
 }
 
-
-func (h *Handler) getPromptResponseVertexAI(prompt string, userInput string, maxTokens int) (string, error) {
-	model := h.aiGoogle.GenerativeModel(cfg.VertexAIModel())
-
-	model.SafetySettings = []*genai.SafetySetting{
-		{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockOnlyHigh},
-		{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockOnlyHigh},
-		{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockOnlyHigh},
-		{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockOnlyHigh},
-	}
-	model.SystemInstruction = &genai.Content{
-		Parts: []genai.Part{genai.Text(prompt)},
-	}
-	model.SetMaxOutputTokens(int32(maxTokens))
-	model.SetCandidateCount(1)
-
-	ytURLs, cleanedInput := extractYouTubeURLs(userInput)
-	vParts := make([]genai.Part, 0, len(ytURLs)+1)
-	for _, u := range ytURLs {
-		vParts = append(vParts, genai.FileData{FileURI: u, MIMEType: "video/mp4"})
-	}
-	vParts = append(vParts, genai.Text(cleanedInput))
-	resp, err := model.GenerateContent(context.Background(), vParts...)
-	if err != nil {
-		log.Println("Error generating content:", err)
-		return "Error generating answer: " + err.Error(), err
-	}
-
-	var respText string
-	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				respText = fmt.Sprintf("%s%s", respText, part)
-			}
-		}
-	}
-	return respText, nil
+func (h *Handler) GetImageFromPromptBanana(ctx context.Context, prompt string, model string, onUsage UsageFunc) ([]byte, string, error) {
+	return h.EditImageFromPromptBanana(ctx, prompt, model, nil, onUsage)
 }
 
-func (h *Handler) GetImageFromPromptBanana(prompt string) ([]byte, string, error) {
+// EditImageFromPromptBanana draws an image from the prompt using the given images as input,
+// without images it is plain text-to-image. onUsage may be nil.
+func (h *Handler) EditImageFromPromptBanana(ctx context.Context, prompt string, model string, images []Image, onUsage UsageFunc) ([]byte, string, error) {
 	if h.geminiDirect == nil {
 		return nil, "", fmt.Errorf("banana unavailable: GEMINI_DIRECT_KEY not configured")
 	}
 
+	parts := make([]*genaisdk.Part, 0, len(images)+1)
+	for _, img := range images {
+		parts = append(parts, genaisdk.NewPartFromBytes(img.Data, img.MIMEType))
+	}
+	parts = append(parts, genaisdk.NewPartFromText(prompt))
+
 	// gemini-*-flash-image generates images via GenerateContent (image modality),
 	// not GenerateImages (the Imagen predict endpoint, which 404s for gemini models)
-	resp, err := h.geminiDirect.Models.GenerateContent(
-		context.Background(),
-		cfg.GetImageModelBackendName(cfg.ImageModelGemini31),
-		genaisdk.Text(prompt),
-		&genaisdk.GenerateContentConfig{
-			ResponseModalities: []string{"IMAGE"},
-		},
-	)
+	var resp *genaisdk.GenerateContentResponse
+	err := retry(ctx, model, func(ctx context.Context) error {
+		var err error
+		resp, err = h.geminiDirect.Models.GenerateContent(
+			ctx,
+			model,
+			[]*genaisdk.Content{genaisdk.NewContentFromParts(parts, genaisdk.RoleUser)},
+			&genaisdk.GenerateContentConfig{
+				ResponseModalities: []string{"IMAGE"},
+			},
+		)
+		return err
+	})
 	if err != nil {
 		log.Println("Banana image error:", err)
 		return nil, "", err
 	}
+	usage := geminiUsage(resp.UsageMetadata)
+	defer func() { reportModelUsage(onUsage, model, usage) }()
+	if err := geminiBlocked(resp); err != nil {
+		return nil, "", err
+	}
 
 	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
 		return nil, "", fmt.Errorf("no image data returned from gemini")
@@ -220,6 +124,7 @@ func (h *Handler) GetImageFromPromptBanana(prompt string) ([]byte, string, error
 
 	for _, part := range resp.Candidates[0].Content.Parts {
 		if part.InlineData != nil && len(part.InlineData.Data) > 0 {
+			usage.Images = 1
 			return part.InlineData.Data, part.InlineData.MIMEType, nil
 		}
 	}
@@ -227,22 +132,34 @@ func (h *Handler) GetImageFromPromptBanana(prompt string) ([]byte, string, error
 	return nil, "", fmt.Errorf("no image data returned from gemini")
 }
 
-func (h *Handler) GetImageFromPrompt(prompt string) ([]byte, string, error) {
+// GetImageFromPrompt draws an image with gpt-image, onUsage may be nil
+func (h *Handler) GetImageFromPrompt(ctx context.Context, prompt string, model string, onUsage UsageFunc) ([]byte, string, error) {
 	// ponytail: gpt-image-* rejects response_format and always returns b64_json
-	img, err := h.aiOAI.CreateImage(context.Background(),
-		openai.ImageRequest{
-			Prompt:  prompt,
-			N:       1,
-			Size:    openai.CreateImageSize1536x1024,
-			Quality: openai.CreateImageQualityHigh,
-			Model:   cfg.GetImageModelBackendName(cfg.ImageModelGPTImage2),
-		})
+	var img openai.ImageResponse
+	err := retry(ctx, model, func(ctx context.Context) error {
+		var err error
+		img, err = h.aiOAI.CreateImage(ctx,
+			openai.ImageRequest{
+				Prompt:  prompt,
+				N:       1,
+				Size:    openai.CreateImageSize1536x1024,
+				Quality: openai.CreateImageQualityHigh,
+				Model:   model,
+			})
+		return err
+	})
 	if err != nil {
 		sentry.CaptureException(err)
 		log.Println("Image error:", err)
 		return nil, "", err
 	}
 
+	reportModelUsage(onUsage, model, Usage{
+		PromptTokens:     img.Usage.InputTokens,
+		CompletionTokens: img.Usage.OutputTokens,
+		Images:           len(img.Data),
+	})
+
 	if len(img.Data) == 0 || img.Data[0].B64JSON == "" {
 		err := fmt.Errorf("no image data returned from API")
 		sentry.CaptureException(err)
@@ -0,0 +1,294 @@
+package aihandler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// CalculatorTool evaluates arithmetic expressions, models are bad at arithmetic and sound sure about it
+type CalculatorTool struct{}
+
+func NewCalculatorTool() *CalculatorTool {
+	return &CalculatorTool{}
+}
+
+func (t *CalculatorTool) Name() string {
+	return "calculator"
+}
+
+func (t *CalculatorTool) Description() string {
+	return "Evaluates an arithmetic expression and returns the exact result. " +
+		"Supports + - * / % ^, parentheses, constants pi and e, and functions " +
+		"sqrt, abs, round, floor, ceil, exp, ln, log10, log2, sin, cos, tan (radians). " +
+		"Use it for any calculation instead of computing in your head."
+}
+
+func (t *CalculatorTool) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"expression": map[string]any{
+				"type":        "string",
+				"description": "expression to evaluate, for example (1200 * 0.13) / 12",
+			},
+		},
+		"required": []string{"expression"},
+	}
+}
+
+func (t *CalculatorTool) Call(args map[string]any) (string, error) {
+	expression, _ := args["expression"].(string)
+	if strings.TrimSpace(expression) == "" {
+		return "", fmt.Errorf("expression is required")
+	}
+
+	result, err := evaluate(expression)
+	if err != nil {
+		return "", err
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return "", fmt.Errorf("result is not a finite number")
+	}
+
+	return strconv.FormatFloat(result, 'g', 15, 64), nil
+}
+
+var calcFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"round": math.Round,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"exp":   math.Exp,
+	"ln":    math.Log,
+	"log":   math.Log10,
+	"log10": math.Log10,
+	"log2":  math.Log2,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+}
+
+var calcConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// evaluate parses the expression with recursive descent:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = ("-" | "+") unary | power
+//	power  = atom [ "^" unary ]
+//	atom   = number | constant | function "(" expr ")" | "(" expr ")"
+func evaluate(expression string) (float64, error) {
+	p := &calcParser{input: []rune(strings.ReplaceAll(expression, "**", "^"))}
+	result, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+
+	return result, nil
+}
+
+type calcParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *calcParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// next returns the next significant symbol without consuming it, 0 at the end of input
+func (p *calcParser) next() rune {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *calcParser) expr() (float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op := p.next()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *calcParser) term() (float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op := p.next()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			left *= right
+		case '/':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left /= right
+		case '%':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *calcParser) unary() (float64, error) {
+	switch p.next() {
+	case '-':
+		p.pos++
+		value, err := p.unary()
+		return -value, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *calcParser) power() (float64, error) {
+	base, err := p.atom()
+	if err != nil {
+		return 0, err
+	}
+
+	if p.next() != '^' {
+		return base, nil
+	}
+	p.pos++
+
+	// right associative: 2^3^2 is 2^9
+	exponent, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *calcParser) atom() (float64, error) {
+	c := p.next()
+	switch {
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.next() != ')' {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+	case unicode.IsDigit(c) || c == '.':
+		return p.number()
+	case unicode.IsLetter(c):
+		return p.name()
+	}
+
+	return 0, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+}
+
+func (p *calcParser) number() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	// exponent notation, 1.5e6
+	if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		end := p.pos + 1
+		if end < len(p.input) && (p.input[end] == '-' || p.input[end] == '+') {
+			end++
+		}
+		if end < len(p.input) && unicode.IsDigit(p.input[end]) {
+			p.pos = end
+			for p.pos < len(p.input) && unicode.IsDigit(p.input[p.pos]) {
+				p.pos++
+			}
+		}
+	}
+
+	value, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", string(p.input[start:p.pos]))
+	}
+	return value, nil
+}
+
+func (p *calcParser) name() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos])) {
+		p.pos++
+	}
+	name := strings.ToLower(string(p.input[start:p.pos]))
+
+	if value, ok := calcConstants[name]; ok {
+		return value, nil
+	}
+
+	fn, ok := calcFunctions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown function or constant %s", name)
+	}
+	if p.next() != '(' {
+		return 0, fmt.Errorf("%s needs an argument in parentheses", name)
+	}
+	p.pos++
+
+	arg, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.next() != ')' {
+		return 0, fmt.Errorf("missing closing parenthesis")
+	}
+	p.pos++
+
+	return fn(arg), nil
+}
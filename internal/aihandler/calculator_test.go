@@ -0,0 +1,94 @@
+package aihandler
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 4 / 3", 1},
+		{"7 % 4", 3},
+		{"2 ^ 3 ^ 2", 512},
+		{"2 ** 10", 1024},
+		{"-3 + 5", 2},
+		{"-2 ^ 2", -4},
+		{"2 ^ -1", 0.5},
+		{"--3", 3},
+		{"+4", 4},
+		{"3 * -2", -6},
+		{"1.5e3 + .5", 1500.5},
+		{"2E-2", 0.02},
+		{"sqrt(16) + abs(-2)", 6},
+		{"round(2.5) + floor(1.9) + ceil(1.1)", 6},
+		{"log10(1000) + log2(8) + ln(e)", 7},
+		{"PI", math.Pi},
+		{"(1200 * 0.13) / 12", 13},
+		{"  2*(3+(4-1))  ", 12},
+	}
+	for _, tt := range tests {
+		got, err := evaluate(tt.expression)
+		if err != nil {
+			t.Errorf("evaluate(%q) error = %v", tt.expression, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("evaluate(%q) = %v, want %v", tt.expression, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"1 / 0", "division by zero"},
+		{"5 % (2 - 2)", "division by zero"},
+		{"(1 + 2", "missing closing parenthesis"},
+		{"sqrt(4", "missing closing parenthesis"},
+		{"1 +", "unexpected end of expression"},
+		{"", "unexpected end of expression"},
+		{"2 3", "unexpected '3' at position 3"},
+		{"1 + )", "unexpected ')' at position 5"},
+		{"foo(1)", "unknown function or constant foo"},
+		{"sqrt 4", "sqrt needs an argument in parentheses"},
+		{"1.2.3", "invalid number 1.2.3"},
+	}
+	for _, tt := range tests {
+		_, err := evaluate(tt.expression)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("evaluate(%q) error = %v, want %q", tt.expression, err, tt.want)
+		}
+	}
+}
+
+func TestCalculatorCall(t *testing.T) {
+	tests := []struct {
+		expression any
+		want       string
+		fails      bool
+	}{
+		{"0.1 + 0.2", "0.3", false},
+		{"1 / 3", "0.333333333333333", false},
+		{"2 ^ 64", "1.84467440737096e+19", false},
+		{"sqrt(-1)", "", true},
+		{"10 ^ 400", "", true},
+		{"   ", "", true},
+		{nil, "", true},
+	}
+	tool := NewCalculatorTool()
+	for _, tt := range tests {
+		got, err := tool.Call(map[string]any{"expression": tt.expression})
+		if (err != nil) != tt.fails || got != tt.want {
+			t.Errorf("Call(%v) = %q, %v, want %q, failure %v", tt.expression, got, err, tt.want, tt.fails)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package aihandler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+)
+
+// ApplyCatalog replaces the text providers with the enabled models of the catalog.
+// Models of backends without a configured client are skipped.
+func (h *Handler) ApplyCatalog(catalog cfg.Catalog) {
+	endpoints := make(map[string]*openai.Client, len(catalog.Endpoints))
+	for _, endpoint := range catalog.Endpoints {
+		endpoints[endpoint.Name] = newEndpointClient(endpoint)
+	}
+
+	var providers []TextProvider
+	for _, model := range catalog.TextModels() {
+		provider, err := h.newProvider(model, endpoints)
+		if err != nil {
+			log.Println("Skipping model", model.Alias+":", err)
+			continue
+		}
+		providers = append(providers, provider)
+	}
+
+	h.providers.Replace(providers)
+}
+
+func (h *Handler) newProvider(model cfg.TextModel, endpoints map[string]*openai.Client) (TextProvider, error) {
+	caps := Capabilities{
+		Vision:     model.Vision,
+		Tools:      model.Tools,
+		Streaming:  model.Streaming,
+		MaxContext: model.MaxContext,
+		MaxTokens:  model.MaxTokens,
+	}
+	completionTokens := model.TokenParam == cfg.TokenParamMaxCompletionTokens
+
+	switch model.Provider {
+	case cfg.ProviderOpenAI:
+		if h.clients.OpenAI == nil {
+			return nil, fmt.Errorf("openai is not configured")
+		}
+		caps.Vendor = VendorOpenAI
+		return NewOAIProvider(model.Alias, h.clients.OpenAI, model.Backend, completionTokens, caps), nil
+	case cfg.ProviderDeepSeek:
+		if h.clients.DeepSeek == nil {
+			return nil, fmt.Errorf("deepseek is not configured")
+		}
+		caps.Vendor = VendorDeepSeek
+		return NewOAIProvider(model.Alias, h.clients.DeepSeek, model.Backend, completionTokens, caps), nil
+	case cfg.ProviderGemini:
+		caps.Vendor = VendorGoogle
+		if h.clients.Gemini != nil {
+			return NewGeminiProvider(model.Alias, h.clients.Gemini, model.Backend, caps), nil
+		}
+		if h.clients.Vertex == nil {
+			return nil, fmt.Errorf("gemini is not configured")
+		}
+		return NewVertexProvider(model.Alias, h.clients.Vertex, model.Backend, caps), nil
+	case cfg.ProviderVertex:
+		if h.clients.Vertex == nil {
+			return nil, fmt.Errorf("vertex is not configured")
+		}
+		caps.Vendor = VendorGoogle
+		return NewVertexProvider(model.Alias, h.clients.Vertex, model.Backend, caps), nil
+	}
+
+	if client, ok := endpoints[model.Provider]; ok {
+		caps.Vendor = VendorCompatible
+		return NewOAIProvider(model.Alias, client, model.Backend, completionTokens, caps), nil
+	}
+
+	return nil, fmt.Errorf("unknown provider %s", model.Provider)
+}
+
+// newEndpointClient creates the client of the OpenAI-compatible endpoint
+func newEndpointClient(endpoint cfg.Endpoint) *openai.Client {
+	config := openai.DefaultConfig(endpoint.APIKey())
+	config.BaseURL = endpoint.BaseURL
+	config.HTTPClient = NewHTTPClient()
+	if len(endpoint.Headers) > 0 {
+		config.HTTPClient = &http.Client{
+			Transport: headerTransport{headers: endpoint.Headers, base: retryAfterTransport{base: http.DefaultTransport}},
+		}
+	}
+	return openai.NewClientWithConfig(config)
+}
+
+// headerTransport adds the endpoint headers to every request, OpenRouter wants to know the app for example
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,54 @@
+package aihandler
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeTool tells the model the current date and time, models have no clock and guess it from the training data
+type TimeTool struct {
+	location *time.Location
+}
+
+// NewTimeTool creates the tool answering in the given location, UTC is used if it is nil
+func NewTimeTool(location *time.Location) *TimeTool {
+	if location == nil {
+		location = time.UTC
+	}
+	return &TimeTool{location: location}
+}
+
+func (t *TimeTool) Name() string {
+	return "current_datetime"
+}
+
+func (t *TimeTool) Description() string {
+	return "Returns the current date, time and weekday in the chat timezone or in the given IANA timezone. " +
+		"Use it for any question about today, now, dates or how much time is left."
+}
+
+func (t *TimeTool) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"timezone": map[string]any{
+				"type":        "string",
+				"description": "IANA timezone like Europe/Berlin, omit to use the chat timezone",
+			},
+		},
+	}
+}
+
+func (t *TimeTool) Call(args map[string]any) (string, error) {
+	location := t.location
+	if name, _ := args["timezone"].(string); name != "" {
+		var err error
+		location, err = time.LoadLocation(name)
+		if err != nil {
+			return "", fmt.Errorf("unknown timezone %s", name)
+		}
+	}
+
+	now := time.Now().In(location)
+	return now.Format("Monday, 2 January 2006, 15:04:05") + " (" + location.String() + ", UTC" + now.Format("-07:00") + ")", nil
+}
@@ -0,0 +1,40 @@
+package aihandler
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeCall(t *testing.T) {
+	tests := []struct {
+		location *time.Location
+		timezone any
+		want     string
+	}{
+		{nil, nil, "(UTC, UTC+00:00)"},
+		{time.FixedZone("Moscow", 3*60*60), nil, "(Moscow, UTC+03:00)"},
+		{time.FixedZone("Moscow", 3*60*60), "", "(Moscow, UTC+03:00)"},
+		{time.FixedZone("Moscow", 3*60*60), "UTC", "(UTC, UTC+00:00)"},
+	}
+	for _, tt := range tests {
+		got, err := NewTimeTool(tt.location).Call(map[string]any{"timezone": tt.timezone})
+		if err != nil {
+			t.Errorf("Call(%v) in %v error = %v", tt.timezone, tt.location, err)
+			continue
+		}
+		if !strings.HasSuffix(got, tt.want) {
+			t.Errorf("Call(%v) in %v = %q, want the zone %q", tt.timezone, tt.location, got, tt.want)
+		}
+		if _, err := time.Parse("Monday, 2 January 2006, 15:04:05", strings.TrimSuffix(got, " "+tt.want)); err != nil {
+			t.Errorf("Call(%v) in %v = %q, the date is not readable: %v", tt.timezone, tt.location, got, err)
+		}
+	}
+}
+
+func TestTimeCallUnknownTimezone(t *testing.T) {
+	_, err := NewTimeTool(nil).Call(map[string]any{"timezone": "Mars/Olympus"})
+	if err == nil || !strings.Contains(err.Error(), "unknown timezone Mars/Olympus") {
+		t.Errorf("Call(Mars/Olympus) error = %v, want unknown timezone", err)
+	}
+}
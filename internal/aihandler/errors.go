@@ -0,0 +1,163 @@
+package aihandler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/sashabaranov/go-openai"
+	genaisdk "google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error classes of the providers, match them with errors.Is
+var (
+	ErrRateLimited    = errors.New("too many requests to the model")
+	ErrQuotaExceeded  = errors.New("provider quota is exceeded")
+	ErrSafetyBlocked  = errors.New("answer is blocked by the safety filter")
+	ErrUnavailable    = errors.New("model is unavailable")
+	ErrTimeout        = errors.New("model did not answer in time")
+	ErrAuth           = errors.New("provider rejected the credentials")
+	ErrInvalidRequest = errors.New("provider rejected the request")
+)
+
+// Error is a classified provider error, errors.Is matches both the class and the original error
+type Error struct {
+	Kind       error         // one of the Err* classes
+	RetryAfter time.Duration // how long the provider asked to wait, 0 if it did not say
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// retryable reports whether the same request may succeed if sent again
+func retryable(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// classify wraps the error of a provider call into Error, errors of unknown kind are returned as is
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	kind, retryAfter := errorKind(err)
+	if kind == nil {
+		return err
+	}
+	return &Error{Kind: kind, RetryAfter: retryAfter, Err: err}
+}
+
+//nolint:gocyclo
+func errorKind(err error) (error, time.Duration) {
+	var oaiErr *openai.APIError
+	if errors.As(err, &oaiErr) {
+		switch code, _ := oaiErr.Code.(string); code {
+		case "insufficient_quota":
+			return ErrQuotaExceeded, 0
+		case "content_policy_violation", "moderation_blocked", "content_filter":
+			return ErrSafetyBlocked, 0
+		}
+		return statusKind(oaiErr.HTTPStatusCode), 0
+	}
+	var oaiReqErr *openai.RequestError
+	if errors.As(err, &oaiReqErr) {
+		return statusKind(oaiReqErr.HTTPStatusCode), 0
+	}
+
+	var geminiErr genaisdk.APIError
+	if errors.As(err, &geminiErr) {
+		return statusKind(geminiErr.Code), geminiRetryDelay(geminiErr.Details)
+	}
+
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return ErrSafetyBlocked, 0
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		switch st.Code() {
+		case codes.ResourceExhausted:
+			return ErrRateLimited, 0
+		case codes.Unavailable, codes.Internal, codes.Aborted:
+			return ErrUnavailable, 0
+		case codes.DeadlineExceeded:
+			return ErrTimeout, 0
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return ErrAuth, 0
+		case codes.InvalidArgument, codes.NotFound, codes.FailedPrecondition:
+			return ErrInvalidRequest, 0
+		}
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return nil, 0
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout, 0
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout, 0
+	case netErr != nil, errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrUnavailable, 0
+	}
+
+	return nil, 0
+}
+
+// statusKind maps the HTTP status of a failed request to the error class
+func statusKind(code int) error {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case code == http.StatusRequestTimeout, code == http.StatusGatewayTimeout:
+		return ErrTimeout
+	case code == http.StatusUnauthorized, code == http.StatusForbidden, code == http.StatusPaymentRequired:
+		return ErrAuth
+	case code >= 500:
+		return ErrUnavailable
+	case code >= 400:
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// statusError is the error of a request made by hand, the Retry-After header is kept
+func statusError(resp *http.Response, err error) error {
+	kind := statusKind(resp.StatusCode)
+	if kind == nil {
+		return err
+	}
+	return &Error{Kind: kind, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")), Err: err}
+}
+
+// geminiRetryDelay finds the delay of google.rpc.RetryInfo among the error details, like "17s"
+func geminiRetryDelay(details []map[string]any) time.Duration {
+	for _, detail := range details {
+		if kind, _ := detail["@type"].(string); !strings.HasSuffix(kind, "google.rpc.RetryInfo") {
+			continue
+		}
+		if delay, ok := detail["retryDelay"].(string); ok {
+			d, err := time.ParseDuration(delay)
+			if err == nil {
+				return d
+			}
+		}
+	}
+	return 0
+}
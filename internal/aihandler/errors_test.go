@@ -0,0 +1,166 @@
+package aihandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/sashabaranov/go-openai"
+	genaisdk "google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStatusKind(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusTooManyRequests, ErrRateLimited},
+		{http.StatusRequestTimeout, ErrTimeout},
+		{http.StatusGatewayTimeout, ErrTimeout},
+		{http.StatusUnauthorized, ErrAuth},
+		{http.StatusForbidden, ErrAuth},
+		{http.StatusPaymentRequired, ErrAuth},
+		{http.StatusInternalServerError, ErrUnavailable},
+		{http.StatusServiceUnavailable, ErrUnavailable},
+		{http.StatusBadRequest, ErrInvalidRequest},
+		{http.StatusNotFound, ErrInvalidRequest},
+		{http.StatusOK, nil},
+		{0, nil},
+	}
+	for _, tt := range tests {
+		if got := statusKind(tt.code); got != tt.want {
+			t.Errorf("statusKind(%d) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"openai rate limit", &openai.APIError{HTTPStatusCode: 429}, ErrRateLimited},
+		{"openai quota", &openai.APIError{HTTPStatusCode: 429, Code: "insufficient_quota"}, ErrQuotaExceeded},
+		{"openai moderation", &openai.APIError{HTTPStatusCode: 400, Code: "content_policy_violation"}, ErrSafetyBlocked},
+		{"openai server error", &openai.APIError{HTTPStatusCode: 502}, ErrUnavailable},
+		{"openai request error", &openai.RequestError{HTTPStatusCode: 401}, ErrAuth},
+		{"gemini rate limit", genaisdk.APIError{Code: 429}, ErrRateLimited},
+		{"gemini bad request", genaisdk.APIError{Code: 400}, ErrInvalidRequest},
+		{"vertex blocked", &genai.BlockedError{}, ErrSafetyBlocked},
+		{"grpc resource exhausted", status.Error(codes.ResourceExhausted, "quota"), ErrRateLimited},
+		{"grpc unavailable", status.Error(codes.Unavailable, "down"), ErrUnavailable},
+		{"grpc internal", status.Error(codes.Internal, "oops"), ErrUnavailable},
+		{"grpc deadline", status.Error(codes.DeadlineExceeded, "slow"), ErrTimeout},
+		{"grpc permission", status.Error(codes.PermissionDenied, "no"), ErrAuth},
+		{"grpc invalid argument", status.Error(codes.InvalidArgument, "bad"), ErrInvalidRequest},
+		{"wrapped", fmt.Errorf("generate: %w", &openai.APIError{HTTPStatusCode: 503}), ErrUnavailable},
+		{"context deadline", context.DeadlineExceeded, ErrTimeout},
+		{"network timeout", timeoutError{}, ErrTimeout},
+		{"broken stream", io.ErrUnexpectedEOF, ErrUnavailable},
+		{"canceled", context.Canceled, nil},
+		{"unknown", errors.New("something"), nil},
+	}
+	for _, tt := range tests {
+		got := classify(tt.err)
+		if tt.want == nil {
+			if got != tt.err {
+				t.Errorf("%s: classify(%v) = %v, want the error as is", tt.name, tt.err, got)
+			}
+			continue
+		}
+		if !errors.Is(got, tt.want) {
+			t.Errorf("%s: classify(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+
+	if classify(nil) != nil {
+		t.Error("classify(nil) != nil")
+	}
+	original := &openai.APIError{HTTPStatusCode: 429}
+	classified := classify(original)
+	if !errors.Is(classified, original) {
+		t.Errorf("classify(%v) = %v, does not match the original error", original, classified)
+	}
+	if again := classify(classified); again != classified {
+		t.Errorf("classify of a classified error = %v, want it as is", again)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		kind error
+		want bool
+	}{
+		{ErrRateLimited, true},
+		{ErrUnavailable, true},
+		{ErrTimeout, true},
+		{ErrQuotaExceeded, false},
+		{ErrSafetyBlocked, false},
+		{ErrAuth, false},
+		{ErrInvalidRequest, false},
+	}
+	for _, tt := range tests {
+		err := &Error{Kind: tt.kind, Err: errors.New("failed")}
+		if got := retryable(err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestGeminiRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		details []map[string]any
+		want    time.Duration
+	}{
+		{"retry info", []map[string]any{
+			{"@type": "type.googleapis.com/google.rpc.QuotaFailure"},
+			{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "17s"},
+		}, 17 * time.Second},
+		{"fractional", []map[string]any{{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "1.5s"}}, 1500 * time.Millisecond},
+		{"broken delay", []map[string]any{{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "soon"}}, 0},
+		{"delay of another detail", []map[string]any{{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "retryDelay": "5s"}}, 0},
+		{"no details", nil, 0},
+	}
+	for _, tt := range tests {
+		if got := geminiRetryDelay(tt.details); got != tt.want {
+			t.Errorf("%s: geminiRetryDelay = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	err := classify(genaisdk.APIError{Code: 429, Details: []map[string]any{
+		{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "3s"},
+	}})
+	var classified *Error
+	if !errors.As(err, &classified) || classified.RetryAfter != 3*time.Second {
+		t.Errorf("classify of a Gemini rate limit = %v, want RetryAfter 3s", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}
+	err := statusError(resp, errors.New("speech failed"))
+	var classified *Error
+	if !errors.As(err, &classified) || classified.Kind != ErrRateLimited || classified.RetryAfter != 7*time.Second {
+		t.Errorf("statusError(429, Retry-After: 7) = %#v, want ErrRateLimited after 7s", err)
+	}
+
+	plain := errors.New("strange")
+	if got := statusError(&http.Response{StatusCode: http.StatusOK}, plain); got != plain {
+		t.Errorf("statusError(200) = %v, want the error as is", got)
+	}
+}
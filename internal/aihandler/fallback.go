@@ -0,0 +1,143 @@
+package aihandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// noDeadlineAttemptTimeout limits a model that has fallbacks when the call has no deadline to share
+const noDeadlineAttemptTimeout = time.Minute
+
+var ErrEmptyAnswer = errors.New("model returned an empty answer")
+
+// GetChatResponseFallback tries req.Model and then the fallback models in order until one answers.
+// Errors, timeouts and empty answers move on to the next model, a done ctx stops the chain.
+// The model that answered is returned along with the answer.
+func (h *Handler) GetChatResponseFallback(ctx context.Context, req Request, fallbacks []string) (string, string, error) {
+	var errs []error
+	attempts := h.attempts(req, fallbacks)
+	for i, attempt := range attempts {
+		answer, err := attempt.provider.Generate(ctx, attempt.request(ctx, len(attempts)-i))
+		if err = checkAnswer(answer, err); err != nil {
+			if ctx.Err() != nil {
+				// stopped or out of time, the next model would not make it either
+				return "", "", err
+			}
+			log.Printf("Model %s failed: %v", attempt.req.Model, err)
+			errs = append(errs, fmt.Errorf("%s: %w", attempt.req.Model, err))
+			continue
+		}
+		return answer, attempt.req.Model, nil
+	}
+
+	return "", "", h.attemptsError(req, errs)
+}
+
+// GetChatResponseStreamFallback is GetChatResponseFallback for streaming, every attempt reports its own
+// answer from the beginning, so the text of a failed model is replaced by the next one
+func (h *Handler) GetChatResponseStreamFallback(ctx context.Context, req Request, fallbacks []string, onText StreamFunc) (string, string, error) {
+	var errs []error
+	attempts := h.attempts(req, fallbacks)
+	for i, attempt := range attempts {
+		var answer string
+		var err error
+		attemptReq := attempt.request(ctx, len(attempts)-i)
+		if attempt.provider.Capabilities().Streaming {
+			answer, err = attempt.provider.Stream(ctx, attemptReq, onText)
+		} else {
+			answer, err = attempt.provider.Generate(ctx, attemptReq)
+		}
+		if err = checkAnswer(answer, err); err != nil {
+			if ctx.Err() != nil {
+				// stopped or out of time, the next model would not make it either
+				return "", "", err
+			}
+			log.Printf("Model %s failed: %v", attempt.req.Model, err)
+			errs = append(errs, fmt.Errorf("%s: %w", attempt.req.Model, err))
+			continue
+		}
+		return answer, attempt.req.Model, nil
+	}
+
+	return "", "", h.attemptsError(req, errs)
+}
+
+type attempt struct {
+	provider TextProvider
+	req      Request
+}
+
+// request is the request of the attempt with its share of the time left on ctx, left counts this
+// attempt and the ones after it. A hung model leaves time for the fallbacks, the last one gets all the rest.
+func (a attempt) request(ctx context.Context, left int) Request {
+	if left <= 1 {
+		return a.req
+	}
+
+	timeout := noDeadlineAttemptTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline) / time.Duration(left)
+	}
+	req := a.req
+	if req.Timeout == 0 || timeout < req.Timeout {
+		req.Timeout = timeout
+	}
+	return req
+}
+
+// attempts lists the models to try for the request. Models that are not registered, repeated
+// or cannot see the request images are skipped, models without tools get the request without them.
+func (h *Handler) attempts(req Request, fallbacks []string) []attempt {
+	models := append([]string{req.Model}, fallbacks...)
+	seen := make(map[string]bool, len(models))
+
+	var attempts []attempt
+	for _, model := range models {
+		if seen[model] {
+			continue
+		}
+		seen[model] = true
+
+		provider, err := h.providers.Get(model)
+		if err != nil {
+			continue
+		}
+		caps := provider.Capabilities()
+		if req.HasImages() && !caps.Vision {
+			continue
+		}
+
+		modelReq := req
+		modelReq.Model = model
+		if !caps.Tools {
+			modelReq.Tools = nil
+		}
+		attempts = append(attempts, attempt{provider: provider, req: modelReq})
+	}
+	return attempts
+}
+
+func checkAnswer(answer string, err error) error {
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(answer) == "" {
+		return ErrEmptyAnswer
+	}
+	return nil
+}
+
+func (h *Handler) attemptsError(req Request, errs []error) error {
+	if len(errs) == 0 {
+		// nothing was tried, the lookup of the chat model explains why
+		if _, err := h.provider(req); err != nil {
+			return err
+		}
+		return fmt.Errorf("no model can answer the request")
+	}
+	return errors.Join(errs...)
+}
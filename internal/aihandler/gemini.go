@@ -0,0 +1,245 @@
+package aihandler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	genaisdk "google.golang.org/genai"
+	"mvdan.cc/xurls/v2"
+)
+
+// GeminiProvider talks to Gemini through the Gemini API
+type GeminiProvider struct {
+	name   string
+	client *genaisdk.Client
+	model  string
+	caps   Capabilities
+}
+
+// NewGeminiProvider creates the provider for the backend model, name is the user-facing model name
+func NewGeminiProvider(name string, client *genaisdk.Client, model string, caps Capabilities) *GeminiProvider {
+	return &GeminiProvider{
+		name:   name,
+		client: client,
+		model:  model,
+		caps:   caps,
+	}
+}
+
+func (p *GeminiProvider) Name() string {
+	return p.name
+}
+
+func (p *GeminiProvider) Capabilities() Capabilities {
+	return p.caps
+}
+
+func (p *GeminiProvider) Generate(ctx context.Context, req Request) (string, error) {
+	ctx, cancel := req.context(ctx)
+	defer cancel()
+
+	var usage Usage
+	defer func() { req.reportUsage(usage) }()
+
+	geminiCfg := geminiConfig(req)
+	contents := geminiContents(req.dialog())
+
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			geminiNoTools(geminiCfg)
+		}
+
+		resp, err := p.generate(ctx, contents, geminiCfg, &usage)
+		if err != nil {
+			return "", err
+		}
+
+		calls := resp.FunctionCalls()
+		if len(calls) == 0 || round == maxToolRounds {
+			return resp.Text(), nil
+		}
+
+		// the model content is sent back as is, gemini needs the thought signatures of the calls
+		contents = append(contents, resp.Candidates[0].Content, geminiToolResults(req, calls))
+	}
+}
+
+func (p *GeminiProvider) generate(ctx context.Context, contents []*genaisdk.Content, geminiCfg *genaisdk.GenerateContentConfig, usage *Usage) (*genaisdk.GenerateContentResponse, error) {
+	var resp *genaisdk.GenerateContentResponse
+	err := retry(ctx, p.name, func(ctx context.Context) error {
+		var err error
+		resp, err = p.client.Models.GenerateContent(ctx, p.model, contents, geminiCfg)
+		return err
+	})
+	if err != nil {
+		log.Println("Gemini error:", err)
+		return nil, err
+	}
+	usage.add(geminiUsage(resp.UsageMetadata))
+	if err := geminiBlocked(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (p *GeminiProvider) Stream(ctx context.Context, req Request, onText StreamFunc) (string, error) {
+	ctx, cancel := req.context(ctx)
+	defer cancel()
+
+	var usage Usage
+	defer func() { req.reportUsage(usage) }()
+
+	geminiCfg := geminiConfig(req)
+	contents := geminiContents(req.dialog())
+
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			geminiNoTools(geminiCfg)
+		}
+
+		var text string
+		var calls []*genaisdk.FunctionCall
+		var modelContent *genaisdk.Content
+		var roundUsage Usage
+		// the round is sent again only if nothing was shown yet
+		err := retry(ctx, p.name, func(ctx context.Context) error {
+			text, calls = "", nil
+			roundUsage = Usage{}
+			modelContent = genaisdk.NewContentFromParts(nil, genaisdk.RoleModel)
+			for resp, err := range p.client.Models.GenerateContentStream(ctx, p.model, contents, geminiCfg) {
+				if err != nil {
+					if text != "" {
+						return permanent(err)
+					}
+					return err
+				}
+				// every chunk has the usage of the stream so far
+				if resp.UsageMetadata != nil {
+					roundUsage = geminiUsage(resp.UsageMetadata)
+				}
+				if err := geminiBlocked(resp); err != nil && text == "" {
+					return err
+				}
+				if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil {
+					modelContent.Parts = append(modelContent.Parts, resp.Candidates[0].Content.Parts...)
+				}
+				calls = append(calls, resp.FunctionCalls()...)
+				if chunk := resp.Text(); chunk != "" {
+					text += chunk
+					onText(text)
+				}
+			}
+			return nil
+		})
+		usage.add(roundUsage)
+		if err != nil {
+			log.Println("Gemini stream error:", err)
+			return text, err
+		}
+
+		if len(calls) == 0 || round == maxToolRounds {
+			return text, nil
+		}
+
+		contents = append(contents, modelContent, geminiToolResults(req, calls))
+	}
+}
+
+// geminiBlocked returns ErrSafetyBlocked if the prompt or the answer was blocked and there is no text
+func geminiBlocked(resp *genaisdk.GenerateContentResponse) error {
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		return &Error{Kind: ErrSafetyBlocked, Err: fmt.Errorf("prompt blocked: %s", resp.PromptFeedback.BlockReason)}
+	}
+	if len(resp.Candidates) == 0 || resp.Text() != "" {
+		return nil
+	}
+	switch reason := resp.Candidates[0].FinishReason; reason {
+	case genaisdk.FinishReasonSafety, genaisdk.FinishReasonProhibitedContent, genaisdk.FinishReasonBlocklist,
+		genaisdk.FinishReasonSPII, genaisdk.FinishReasonRecitation, genaisdk.FinishReasonImageSafety,
+		genaisdk.FinishReasonImageProhibitedContent:
+		return &Error{Kind: ErrSafetyBlocked, Err: fmt.Errorf("answer blocked: %s", reason)}
+	}
+	return nil
+}
+
+// extractYouTubeURLs finds YouTube URLs in userInput, returns them and the cleaned text.
+func extractYouTubeURLs(userInput string) ([]string, string) {
+	rxRelaxed := xurls.Relaxed()
+	allURLs := rxRelaxed.FindAllString(userInput, -1)
+	remaining := userInput
+	var ytURLs []string
+	for _, u := range allURLs {
+		if strings.Contains(u, "youtube.com") || strings.Contains(u, "youtu.be") {
+			ytURLs = append(ytURLs, u)
+			remaining = strings.ReplaceAll(remaining, u, "")
+		}
+	}
+	return ytURLs, strings.TrimSpace(remaining)
+}
+
+// geminiContents maps the dialog to gemini contents, images are sent inline.
+// Consecutive turns of the same role are merged into one content. YouTube links are attached as video only for the last turn,
+// older ones stay plain text so the video is not processed again on every answer.
+func geminiContents(turns []Turn) []*genaisdk.Content {
+	contents := make([]*genaisdk.Content, 0, len(turns))
+	for i, turn := range turns {
+		role := genaisdk.RoleUser
+		if turn.Role == RoleAssistant {
+			role = genaisdk.RoleModel
+		}
+
+		var parts []*genaisdk.Part
+		if i == len(turns)-1 {
+			ytURLs, cleanedInput := extractYouTubeURLs(turn.content())
+			for _, u := range ytURLs {
+				parts = append(parts, genaisdk.NewPartFromURI(u, "video/mp4"))
+			}
+			parts = append(parts, genaisdk.NewPartFromText(cleanedInput))
+		} else {
+			parts = append(parts, genaisdk.NewPartFromText(turn.content()))
+		}
+		for _, img := range turn.Images {
+			parts = append(parts, genaisdk.NewPartFromBytes(img.Data, img.MIMEType))
+		}
+
+		if len(contents) > 0 && contents[len(contents)-1].Role == role {
+			contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, genaisdk.NewContentFromParts(parts, genaisdk.Role(role)))
+	}
+	return contents
+}
+
+func geminiConfig(req Request) *genaisdk.GenerateContentConfig {
+	geminiCfg := &genaisdk.GenerateContentConfig{
+		SystemInstruction: genaisdk.NewContentFromText(req.systemPrompt(), "user"),
+		SafetySettings: []*genaisdk.SafetySetting{
+			{Category: genaisdk.HarmCategoryHarassment, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
+			{Category: genaisdk.HarmCategoryHateSpeech, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
+			{Category: genaisdk.HarmCategorySexuallyExplicit, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
+			{Category: genaisdk.HarmCategoryDangerousContent, Threshold: genaisdk.HarmBlockThresholdBlockOnlyHigh},
+		},
+	}
+	if len(req.Tools) > 0 {
+		declarations := make([]*genaisdk.FunctionDeclaration, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			declarations = append(declarations, &genaisdk.FunctionDeclaration{
+				Name:                 tool.Name(),
+				Description:          tool.Description(),
+				ParametersJsonSchema: tool.Parameters(),
+			})
+		}
+		geminiCfg.Tools = []*genaisdk.Tool{{FunctionDeclarations: declarations}}
+	}
+	return geminiCfg
+}
+
+// geminiNoTools forbids further tool calls, used for the last round
+func geminiNoTools(geminiCfg *genaisdk.GenerateContentConfig) {
+	geminiCfg.ToolConfig = &genaisdk.ToolConfig{
+		FunctionCallingConfig: &genaisdk.FunctionCallingConfig{Mode: genaisdk.FunctionCallingConfigModeNone},
+	}
+}
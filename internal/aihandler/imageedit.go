@@ -0,0 +1,142 @@
+package aihandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// go-openai does not send the model field to /images/edits, so it always hits dall-e-2.
+// The edit request is built by hand until the library supports gpt-image models.
+const oaiImageEditsPath = "/images/edits"
+
+var imageEditClient = &http.Client{Timeout: 3 * time.Minute}
+
+type oaiImageResponse struct {
+	Data []struct {
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	} `json:"error"`
+}
+
+// EditImageFromPrompt redraws the given images according to the prompt with gpt-image, onUsage may be nil
+func (h *Handler) EditImageFromPrompt(ctx context.Context, prompt string, model string, images []Image, onUsage UsageFunc) ([]byte, string, error) {
+	if h.oaiAccount.APIKey == "" {
+		return nil, "", fmt.Errorf("image edits not available")
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for i, img := range images {
+		ext := "png"
+		if img.MIMEType == "image/jpeg" {
+			ext = "jpg"
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image[]"; filename="image%d.%s"`, i, ext))
+		header.Set("Content-Type", img.MIMEType)
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(img.Data); err != nil {
+			return nil, "", err
+		}
+	}
+	fields := map[string]string{
+		"model":   model,
+		"prompt":  prompt,
+		"n":       "1",
+		"quality": "high",
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, "", err
+	}
+
+	var result oaiImageResponse
+	err := retry(ctx, model, func(ctx context.Context) error {
+		var err error
+		result, err = h.sendImageEdit(ctx, body.Bytes(), form.FormDataContentType())
+		return err
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println("Image edit error:", err)
+		return nil, "", err
+	}
+	reportModelUsage(onUsage, model, Usage{
+		PromptTokens:     result.Usage.InputTokens,
+		CompletionTokens: result.Usage.OutputTokens,
+		Images:           len(result.Data),
+	})
+	if len(result.Data) == 0 || result.Data[0].B64JSON == "" {
+		err := fmt.Errorf("no image data returned from API")
+		sentry.CaptureException(err)
+		return nil, "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(result.Data[0].B64JSON)
+	if err != nil {
+		sentry.CaptureException(err)
+		return nil, "", err
+	}
+
+	return data, "image/png", nil
+}
+
+// sendImageEdit makes a single edit request, failed statuses keep their class for retry
+func (h *Handler) sendImageEdit(ctx context.Context, body []byte, contentType string) (oaiImageResponse, error) {
+	var result oaiImageResponse
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.oaiAccount.url(oaiImageEditsPath), bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.oaiAccount.APIKey)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := imageEditClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return result, err
+	}
+
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return result, statusError(resp, fmt.Errorf("image edit failed: %s", resp.Status))
+	}
+	if result.Error != nil {
+		if result.Error.Code == "moderation_blocked" || result.Error.Code == "content_policy_violation" {
+			return result, &Error{Kind: ErrSafetyBlocked, Err: fmt.Errorf("image edit failed: %s", result.Error.Message)}
+		}
+		return result, statusError(resp, fmt.Errorf("image edit failed: %s", result.Error.Message))
+	}
+
+	return result, nil
+}
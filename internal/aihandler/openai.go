@@ -0,0 +1,279 @@
+package aihandler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAIAccount is the OpenAI API the bot works with. The openai client is made from it, and the requests
+// the client can not make, like gpt-image edits, go to the same base URL with the same key.
+type OpenAIAccount struct {
+	BaseURL string // the official API if empty
+	APIKey  string
+}
+
+// Client creates the openai client of the account
+func (a OpenAIAccount) Client() *openai.Client {
+	config := openai.DefaultConfig(a.APIKey)
+	if a.BaseURL != "" {
+		config.BaseURL = a.BaseURL
+	}
+	config.HTTPClient = NewHTTPClient()
+	return openai.NewClientWithConfig(config)
+}
+
+// url returns the address of the API method, path starts with a slash
+func (a OpenAIAccount) url(path string) string {
+	baseURL := a.BaseURL
+	if baseURL == "" {
+		baseURL = openai.DefaultConfig("").BaseURL
+	}
+	return strings.TrimRight(baseURL, "/") + path
+}
+
+// OAIProvider talks to OpenAI and the APIs compatible with it, DeepSeek is one of them
+type OAIProvider struct {
+	name   string
+	client *openai.Client
+	model  string
+	// newer OpenAI models reject max_tokens and require max_completion_tokens
+	completionTokens bool
+	caps             Capabilities
+}
+
+// NewOAIProvider creates the provider for the backend model, name is the user-facing model name
+func NewOAIProvider(name string, client *openai.Client, model string, completionTokens bool, caps Capabilities) *OAIProvider {
+	return &OAIProvider{
+		name:             name,
+		client:           client,
+		model:            model,
+		completionTokens: completionTokens,
+		caps:             caps,
+	}
+}
+
+func (p *OAIProvider) Name() string {
+	return p.name
+}
+
+func (p *OAIProvider) Capabilities() Capabilities {
+	return p.caps
+}
+
+func (p *OAIProvider) Generate(ctx context.Context, req Request) (string, error) {
+	if p.client == nil {
+		return "", fmt.Errorf("model not available")
+	}
+
+	ctx, cancel := req.context(ctx)
+	defer cancel()
+
+	var usage Usage
+	defer func() { req.reportUsage(usage) }()
+
+	chatReq := oaiChatRequest(req, p.model, p.completionTokens)
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			chatReq.ToolChoice = "none"
+		}
+
+		var resp openai.ChatCompletionResponse
+		err := retry(ctx, p.name, func(ctx context.Context) error {
+			var err error
+			resp, err = p.client.CreateChatCompletion(ctx, chatReq)
+			return err
+		})
+		usage.add(oaiUsage(&resp.Usage))
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println("Completion error:", err)
+			return "", err
+		}
+
+		if len(resp.Choices) == 0 {
+			err := fmt.Errorf("no choices returned from API")
+			sentry.CaptureException(err)
+			return "", err
+		}
+
+		message := resp.Choices[0].Message
+		if message.Content == "" && resp.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+			return "", &Error{Kind: ErrSafetyBlocked, Err: fmt.Errorf("finish reason %s", openai.FinishReasonContentFilter)}
+		}
+		if len(message.ToolCalls) == 0 || round == maxToolRounds {
+			return message.Content, nil
+		}
+
+		chatReq.Messages = append(chatReq.Messages, message)
+		chatReq.Messages = append(chatReq.Messages, oaiToolResults(req, message.ToolCalls)...)
+	}
+}
+
+func (p *OAIProvider) Stream(ctx context.Context, req Request, onText StreamFunc) (string, error) {
+	if p.client == nil {
+		return "", fmt.Errorf("model not available")
+	}
+
+	ctx, cancel := req.context(ctx)
+	defer cancel()
+
+	var usage Usage
+	defer func() { req.reportUsage(usage) }()
+
+	chatReq := oaiChatRequest(req, p.model, p.completionTokens)
+	chatReq.Stream = true
+	chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			chatReq.ToolChoice = "none"
+		}
+
+		text, calls, err := streamOAIRound(ctx, p.client, chatReq, onText, &usage)
+		if err != nil {
+			return text, err
+		}
+
+		if len(calls) == 0 || round == maxToolRounds {
+			if text == "" {
+				err := fmt.Errorf("no choices returned from API")
+				sentry.CaptureException(err)
+				return "", err
+			}
+			return text, nil
+		}
+
+		chatReq.Messages = append(chatReq.Messages, openai.ChatCompletionMessage{
+			Role:      openai.ChatMessageRoleAssistant,
+			Content:   text,
+			ToolCalls: calls,
+		})
+		chatReq.Messages = append(chatReq.Messages, oaiToolResults(req, calls)...)
+	}
+}
+
+// streamOAIRound streams a single completion, tool calls come in pieces and are glued together by their index
+func streamOAIRound(ctx context.Context, client *openai.Client, chatReq openai.ChatCompletionRequest, onText StreamFunc, usage *Usage) (string, []openai.ToolCall, error) {
+	var stream *openai.ChatCompletionStream
+	err := retry(ctx, chatReq.Model, func(ctx context.Context) error {
+		var err error
+		stream, err = client.CreateChatCompletionStream(ctx, chatReq)
+		return err
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println("Completion stream error:", err)
+		return "", nil, err
+	}
+	defer stream.Close()
+
+	var text string
+	var calls []openai.ToolCall
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			err = classify(err)
+			sentry.CaptureException(err)
+			log.Println("Completion stream error:", err)
+			return text, nil, err
+		}
+		// with include_usage the last chunk has the usage and no choices
+		usage.add(oaiUsage(resp.Usage))
+		if len(resp.Choices) == 0 {
+			continue
+		}
+		if text == "" && resp.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+			return "", nil, &Error{Kind: ErrSafetyBlocked, Err: fmt.Errorf("finish reason %s", openai.FinishReasonContentFilter)}
+		}
+
+		delta := resp.Choices[0].Delta
+		for _, call := range delta.ToolCalls {
+			i := len(calls)
+			if call.Index != nil {
+				i = *call.Index
+			}
+			for len(calls) <= i {
+				calls = append(calls, openai.ToolCall{Type: openai.ToolTypeFunction})
+			}
+			if call.ID != "" {
+				calls[i].ID = call.ID
+			}
+			calls[i].Function.Name += call.Function.Name
+			calls[i].Function.Arguments += call.Function.Arguments
+		}
+
+		if delta.Content != "" {
+			text += delta.Content
+			onText(text)
+		}
+	}
+
+	return text, calls, nil
+}
+
+func oaiChatRequest(req Request, model string, useCompletionTokens bool) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Turns))
+	for _, turn := range req.Turns {
+		// speaker names are mostly cyrillic, and the name field only accepts latin,
+		// so they are kept inside the content
+		message := openai.ChatCompletionMessage{Role: oaiRole(turn.Role)}
+		if len(turn.Images) == 0 {
+			message.Content = turn.content()
+		} else {
+			message.MultiContent = []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: turn.content()}}
+			for _, img := range turn.Images {
+				message.MultiContent = append(message.MultiContent, openai.ChatMessagePart{
+					Type: openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{
+						URL: "data:" + img.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(img.Data),
+					},
+				})
+			}
+		}
+		messages = append(messages, message)
+	}
+
+	chatReq := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: messages,
+	}
+	if useCompletionTokens {
+		chatReq.MaxCompletionTokens = req.MaxTokens
+	} else {
+		chatReq.MaxTokens = req.MaxTokens
+	}
+	for _, tool := range req.Tools {
+		chatReq.Tools = append(chatReq.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name(),
+				Description: tool.Description(),
+				Parameters:  tool.Parameters(),
+			},
+		})
+	}
+
+	return chatReq
+}
+
+func oaiRole(role Role) string {
+	switch role {
+	case RoleSystem:
+		return openai.ChatMessageRoleSystem
+	case RoleAssistant:
+		return openai.ChatMessageRoleAssistant
+	default:
+		return openai.ChatMessageRoleUser
+	}
+}
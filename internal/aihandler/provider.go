@@ -0,0 +1,121 @@
+package aihandler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Vendor tells whose limits and settings apply to the model
+type Vendor string
+
+const (
+	VendorOpenAI   Vendor = "openai"
+	VendorGoogle   Vendor = "google"
+	VendorDeepSeek Vendor = "deepseek"
+	// VendorCompatible is any other OpenAI-compatible API declared in the catalog
+	VendorCompatible Vendor = "compatible"
+)
+
+// Capabilities describe what the model behind a provider can do
+type Capabilities struct {
+	Vendor     Vendor
+	Vision     bool // accepts images in the conversation
+	Tools      bool // can call tools
+	Streaming  bool // can return the answer while it is generated
+	MaxContext int  // context window in tokens, 0 if unknown
+	MaxTokens  int  // default answer limit, 0 if the model has none
+}
+
+// TextProvider is a text model backend. Providers are registered in the handler under
+// the user-facing model name, the one chats store in their settings.
+type TextProvider interface {
+	Name() string
+	Capabilities() Capabilities
+	// Generate returns the whole answer, the call gives up when ctx is done
+	Generate(ctx context.Context, req Request) (string, error)
+	// Stream reports the answer while it is generated, providers without streaming
+	// are called through Generate instead
+	Stream(ctx context.Context, req Request, onText StreamFunc) (string, error)
+}
+
+// Registry keeps text providers by model name in the order of registration
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]TextProvider
+	names     []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]TextProvider)}
+}
+
+// Register adds the provider, a provider with the same name is replaced
+func (r *Registry) Register(provider TextProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.providers[provider.Name()]; !ok {
+		r.names = append(r.names, provider.Name())
+	}
+	r.providers[provider.Name()] = provider
+}
+
+func (r *Registry) Get(name string) (TextProvider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown model: %s", name)
+	}
+	return provider, nil
+}
+
+// Replace swaps all registered providers at once, requests running with the old ones finish with them
+func (r *Registry) Replace(providers []TextProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.providers = make(map[string]TextProvider, len(providers))
+	r.names = nil
+	for _, provider := range providers {
+		if _, ok := r.providers[provider.Name()]; !ok {
+			r.names = append(r.names, provider.Name())
+		}
+		r.providers[provider.Name()] = provider
+	}
+}
+
+// Names returns the names of the registered providers in the order of registration
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]string(nil), r.names...)
+}
+
+// RegisterProvider makes the text model available to GetChatResponse
+func (h *Handler) RegisterProvider(provider TextProvider) {
+	h.providers.Register(provider)
+}
+
+// Models returns the names of all registered text models
+func (h *Handler) Models() []string {
+	return h.providers.Names()
+}
+
+// HasModel reports whether the text model is registered
+func (h *Handler) HasModel(model string) bool {
+	_, err := h.providers.Get(model)
+	return err == nil
+}
+
+// Capabilities returns the capabilities of the text model, false if it is not registered
+func (h *Handler) Capabilities(model string) (Capabilities, bool) {
+	provider, err := h.providers.Get(model)
+	if err != nil {
+		return Capabilities{}, false
+	}
+	return provider.Capabilities(), true
+}
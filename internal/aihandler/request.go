@@ -0,0 +1,113 @@
+package aihandler
+
+import (
+	"context"
+	"time"
+)
+
+// Role is the author role of a conversation turn
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Image is an image attached to a turn
+type Image struct {
+	Data     []byte
+	MIMEType string
+}
+
+// Turn is a single message of the conversation sent to the model
+type Turn struct {
+	Role   Role
+	Name   string // speaker name, chats have many users so it is sent along with user turns
+	Text   string
+	Images []Image
+}
+
+// Request is a multi-turn request to a text model. Turns are ordered from the oldest to the newest.
+type Request struct {
+	Model     string
+	MaxTokens int
+	Turns     []Turn
+
+	Tools      []Tool         // tools the model may call before answering, nil disables tool calling
+	OnToolCall func(ToolCall) // called after every tool invocation, may be nil
+	OnUsage    UsageFunc      // called with the tokens the request consumed, may be nil
+
+	Timeout time.Duration // limits the whole answer including tool rounds on top of the call context, 0 means no extra limit
+}
+
+// NewRequest builds a request with a system prompt and a single user input,
+// the way the bot talked to the models before conversation history
+func NewRequest(prompt string, userInput string, model string, maxTokens int) Request {
+	return Request{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Turns: []Turn{
+			{Role: RoleSystem, Text: prompt},
+			{Role: RoleUser, Text: userInput},
+		},
+	}
+}
+
+// context returns the context the provider calls run with, the request timeout applies to it
+func (r Request) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.Timeout > 0 {
+		return context.WithTimeout(ctx, r.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// HasImages reports whether any turn of the request carries an image
+func (r Request) HasImages() bool {
+	for _, turn := range r.Turns {
+		if len(turn.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// content returns the turn text as the model should see it
+func (t Turn) content() string {
+	if t.Role == RoleUser && t.Name != "" {
+		return t.Name + ": " + t.Text
+	}
+	return t.Text
+}
+
+// systemPrompt joins all system turns of the request
+func (r Request) systemPrompt() string {
+	var prompt string
+	for _, turn := range r.Turns {
+		if turn.Role != RoleSystem {
+			continue
+		}
+		if prompt != "" {
+			prompt += "\n\n"
+		}
+		prompt += turn.Text
+	}
+	return prompt
+}
+
+// dialog returns all non-system turns of the request. Gemini rejects a dialog opened by the model,
+// so assistant turns before the first user turn are dropped.
+func (r Request) dialog() []Turn {
+	turns := make([]Turn, 0, len(r.Turns))
+	for _, turn := range r.Turns {
+		if turn.Role != RoleSystem {
+			turns = append(turns, turn)
+		}
+	}
+	for i, turn := range turns {
+		if turn.Role == RoleUser {
+			return turns[i:]
+		}
+	}
+	return turns
+}
@@ -0,0 +1,136 @@
+package aihandler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	retryAttempts  = 4
+	retryBaseDelay = time.Second
+	// the provider asking to wait longer than this is not waited for, the user would give up anyway
+	retryMaxDelay = 30 * time.Second
+)
+
+// retry calls fn until it succeeds, fails with a permanent error or runs out of attempts.
+// Rate limits, 5xx and timeouts are retried with exponential backoff and jitter, the delay
+// the provider asked for with Retry-After wins. The returned error is classified.
+func retry(ctx context.Context, what string, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		hint := &retryAfterHint{}
+		err := fn(context.WithValue(ctx, retryAfterKey{}, hint))
+		if err == nil {
+			return nil
+		}
+
+		var stop *permanentError
+		if errors.As(err, &stop) {
+			return classify(stop.err)
+		}
+
+		err = classify(err)
+		if attempt == retryAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := backoff(attempt)
+		if wait := retryAfter(err, hint); wait > retryMaxDelay {
+			return err
+		} else if wait > 0 {
+			delay = wait
+		}
+
+		log.Printf("%s attempt %d failed, retrying in %s: %v", what, attempt, delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// permanent stops retry, used when a stream failed after a part of the answer was shown
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// backoff is the exponential delay of the attempt with equal jitter
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+func retryAfter(err error, hint *retryAfterHint) time.Duration {
+	var classified *Error
+	if errors.As(err, &classified) && classified.RetryAfter > 0 {
+		return classified.RetryAfter
+	}
+	return time.Duration(hint.delay.Load())
+}
+
+type retryAfterKey struct{}
+
+// retryAfterHint receives the Retry-After header of the failed response, the API clients do not expose headers
+type retryAfterHint struct {
+	delay atomic.Int64
+}
+
+// NewHTTPClient returns the HTTP client for the API clients, it lets retry see the Retry-After header
+func NewHTTPClient() *http.Client {
+	return &http.Client{Transport: retryAfterTransport{base: http.DefaultTransport}}
+}
+
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if hint, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHint); ok {
+		if delay := parseRetryAfter(resp.Header.Get("Retry-After")); delay > 0 {
+			hint.delay.Store(int64(delay))
+		}
+	}
+	return resp, nil
+}
+
+// parseRetryAfter reads the header in seconds or as an HTTP date, 0 if it is missing or broken
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
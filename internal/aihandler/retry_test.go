@@ -0,0 +1,155 @@
+package aihandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"0", 0, 0},
+		{"-3", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), -2 * time.Minute, 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := retryBaseDelay << (attempt - 1)
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		if got := backoff(attempt); got < delay/2 || got >= delay {
+			t.Errorf("backoff(%d) = %s, want between %s and %s", attempt, got, delay/2, delay)
+		}
+	}
+}
+
+// failing returns fn failing with errs one by one and succeeding after them, and the counter of its calls
+func failing(errs ...error) (func(ctx context.Context) error, *int) {
+	calls := 0
+	return func(context.Context) error {
+		calls++
+		if calls > len(errs) {
+			return nil
+		}
+		return errs[calls-1]
+	}, &calls
+}
+
+func rateLimited(wait time.Duration) error {
+	return &Error{Kind: ErrRateLimited, RetryAfter: wait, Err: errors.New("429")}
+}
+
+func TestRetry(t *testing.T) {
+	unknown := errors.New("strange")
+	invalid := &Error{Kind: ErrInvalidRequest, Err: errors.New("400")}
+	tests := []struct {
+		name  string
+		errs  []error
+		want  error // nil for success
+		calls int
+	}{
+		{"success", nil, nil, 1},
+		{"retried until success", []error{rateLimited(time.Millisecond), rateLimited(time.Millisecond)}, nil, 3},
+		{"permanent error", []error{invalid}, ErrInvalidRequest, 1},
+		{"stream failed after the answer was shown", []error{permanent(rateLimited(time.Millisecond))}, ErrRateLimited, 1},
+		{"unknown error", []error{unknown}, unknown, 1},
+		{"out of attempts", []error{rateLimited(time.Millisecond), rateLimited(time.Millisecond),
+			rateLimited(time.Millisecond), rateLimited(time.Millisecond), rateLimited(time.Millisecond)}, ErrRateLimited, retryAttempts},
+		{"asked to wait too long", []error{rateLimited(retryMaxDelay + time.Second)}, ErrRateLimited, 1},
+	}
+	for _, tt := range tests {
+		fn, calls := failing(tt.errs...)
+		err := retry(context.Background(), "test", fn)
+		if (tt.want == nil && err != nil) || !errors.Is(err, tt.want) {
+			t.Errorf("%s: retry = %v, want %v", tt.name, err, tt.want)
+		}
+		if *calls != tt.calls {
+			t.Errorf("%s: fn called %d times, want %d", tt.name, *calls, tt.calls)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fn, calls := failing(rateLimited(0), rateLimited(0))
+	if err := retry(ctx, "test", fn); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("retry = %v, want ErrRateLimited", err)
+	}
+	if *calls != 1 {
+		t.Errorf("fn called %d times after the context was canceled, want once", *calls)
+	}
+
+	// the context canceled while waiting for the next attempt stops the wait
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fn, calls = failing(rateLimited(20*time.Second), rateLimited(0))
+	start := time.Now()
+	if err := retry(ctx, "test", fn); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("retry = %v, want ErrRateLimited", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("retry waited %s after the context was done", elapsed)
+	}
+	if *calls != 1 {
+		t.Errorf("fn called %d times after the context was done, want once", *calls)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	calls := 0
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		if calls == 1 {
+			resp.StatusCode = http.StatusTooManyRequests
+			resp.Header.Set("Retry-After", "1")
+		}
+		return resp, nil
+	})
+	client := &http.Client{Transport: retryAfterTransport{base: base}}
+
+	fn := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			// the API clients lose the header, retry has to read it from the hint
+			return &Error{Kind: statusKind(resp.StatusCode), Err: errors.New(resp.Status)}
+		}
+		return nil
+	}
+	start := time.Now()
+	if err := retry(context.Background(), "test", fn); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retry waited %s, want the second of Retry-After", elapsed)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,162 @@
+package aihandler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sashabaranov/go-openai"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	genaisdk "google.golang.org/genai"
+)
+
+const (
+	transcriptionPrompt = "Transcribe this audio verbatim in its original language. Reply with the transcript only."
+
+	// maxSpeechInput is the OpenAI speech endpoint input limit
+	maxSpeechInput = 4096
+)
+
+// Audio is a recorded speech to transcribe
+type Audio struct {
+	Data     []byte
+	MIMEType string
+	FileName string // some backends detect the format by the file extension
+	Duration int    // seconds, the transcription is billed by it
+}
+
+// Transcriber turns speech into text
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio Audio, onUsage UsageFunc) (string, error)
+}
+
+// OAITranscriber uses the OpenAI transcription endpoint
+type OAITranscriber struct {
+	client *openai.Client
+}
+
+func NewOAITranscriber(client *openai.Client) *OAITranscriber {
+	return &OAITranscriber{client: client}
+}
+
+func (t *OAITranscriber) Transcribe(ctx context.Context, audio Audio, onUsage UsageFunc) (string, error) {
+	if t.client == nil {
+		return "", fmt.Errorf("transcription not available")
+	}
+
+	var resp openai.AudioResponse
+	err := retry(ctx, "transcription", func(ctx context.Context) error {
+		var err error
+		resp, err = t.client.CreateTranscription(ctx, openai.AudioRequest{
+			Model:    cfg.TranscriptionModel(),
+			FilePath: audio.FileName,
+			Reader:   bytes.NewReader(audio.Data),
+			Format:   openai.AudioResponseFormatJSON,
+		})
+		return err
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println("Transcription error:", err)
+		return "", err
+	}
+
+	seconds := audio.Duration
+	if resp.Duration > 0 {
+		seconds = int(math.Ceil(resp.Duration))
+	}
+	reportModelUsage(onUsage, cfg.TranscriptionModel(), Usage{AudioSeconds: seconds})
+
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// GeminiTranscriber sends the audio to gemini as an inline part
+type GeminiTranscriber struct {
+	client *genaisdk.Client
+}
+
+func NewGeminiTranscriber(client *genaisdk.Client) *GeminiTranscriber {
+	return &GeminiTranscriber{client: client}
+}
+
+func (t *GeminiTranscriber) Transcribe(ctx context.Context, audio Audio, onUsage UsageFunc) (string, error) {
+	if t.client == nil {
+		return "", fmt.Errorf("transcription not available: GEMINI_DIRECT_KEY not configured")
+	}
+
+	parts := []*genaisdk.Part{
+		genaisdk.NewPartFromText(transcriptionPrompt),
+		genaisdk.NewPartFromBytes(audio.Data, audio.MIMEType),
+	}
+	var resp *genaisdk.GenerateContentResponse
+	err := retry(ctx, "transcription", func(ctx context.Context) error {
+		var err error
+		resp, err = t.client.Models.GenerateContent(
+			ctx,
+			cfg.GeminiTranscriptionModel(),
+			[]*genaisdk.Content{genaisdk.NewContentFromParts(parts, genaisdk.RoleUser)},
+			nil,
+		)
+		return err
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println("Gemini transcription error:", err)
+		return "", err
+	}
+	reportModelUsage(onUsage, cfg.GeminiTranscriptionModel(), geminiUsage(resp.UsageMetadata))
+
+	return strings.TrimSpace(resp.Text()), nil
+}
+
+// SetTranscriber replaces the speech-to-text backend
+func (h *Handler) SetTranscriber(t Transcriber) {
+	h.transcriber = t
+}
+
+// Transcribe turns the audio into text with the configured transcriber
+func (h *Handler) Transcribe(ctx context.Context, audio Audio, onUsage UsageFunc) (string, error) {
+	if h.transcriber == nil {
+		return "", fmt.Errorf("transcription not available")
+	}
+	return h.transcriber.Transcribe(ctx, audio, onUsage)
+}
+
+// GetSpeechFromText voices the text with the OpenAI speech endpoint.
+// The result is OGG/Opus, the only format telegram shows as a voice message.
+// The speech is billed by the characters of the text.
+func (h *Handler) GetSpeechFromText(ctx context.Context, text string, model string, onUsage UsageFunc) ([]byte, error) {
+	if h.aiOAI == nil {
+		return nil, fmt.Errorf("speech not available")
+	}
+
+	if input := []rune(text); len(input) > maxSpeechInput {
+		text = string(input[:maxSpeechInput])
+	}
+
+	var resp openai.RawResponse
+	err := retry(ctx, "speech", func(ctx context.Context) error {
+		var err error
+		resp, err = h.aiOAI.CreateSpeech(ctx, openai.CreateSpeechRequest{
+			Model:          openai.SpeechModel(cfg.GetSpeechModelBackendName(cfg.SpeechModel(model))),
+			Input:          text,
+			Voice:          openai.SpeechVoice(cfg.SpeechVoice()),
+			ResponseFormat: openai.SpeechResponseFormatOpus,
+		})
+		return err
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println("Speech error:", err)
+		return nil, err
+	}
+	defer resp.Close()
+	reportModelUsage(onUsage, model, Usage{Characters: len([]rune(text))})
+
+	return io.ReadAll(resp)
+}
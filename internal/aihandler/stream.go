@@ -0,0 +1,25 @@
+package aihandler
+
+import "context"
+
+// StreamFunc receives the answer generated so far, every call gets the whole text, not a delta
+type StreamFunc func(text string)
+
+// GetChatResponseStream works like GetChatResponse but reports the answer while it is generated.
+// The full answer is returned when the model is done. Models without streaming report it once.
+func (h *Handler) GetChatResponseStream(ctx context.Context, req Request, onText StreamFunc) (string, error) {
+	provider, err := h.provider(req)
+	if err != nil {
+		return "", err
+	}
+
+	if !provider.Capabilities().Streaming {
+		answer, err := provider.Generate(ctx, req)
+		if err == nil {
+			onText(answer)
+		}
+		return answer, err
+	}
+
+	return provider.Stream(ctx, req, onText)
+}
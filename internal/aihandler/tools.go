@@ -0,0 +1,158 @@
+package aihandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/sashabaranov/go-openai"
+	genaisdk "google.golang.org/genai"
+)
+
+// maxToolRounds limits how many times the model may call tools before it has to answer,
+// the last round is sent without tools
+const maxToolRounds = 5
+
+// Tool is a Go function the model may call while answering.
+// Parameters is a JSON schema of the arguments object, the same one OpenAI and Gemini accept.
+type Tool interface {
+	Name() string
+	Description() string
+	Parameters() map[string]any
+	Call(args map[string]any) (string, error)
+}
+
+// ToolCall is a record of a single tool invocation made by the model
+type ToolCall struct {
+	Tool     string
+	Args     string // arguments as JSON, the way the model sent them
+	Result   string
+	Err      error
+	Duration time.Duration
+}
+
+// callTool runs the tool the model asked for and reports the call to req.OnToolCall.
+// Errors are returned to the model as the result, so it can fix the arguments or answer without the tool.
+func callTool(req Request, name string, args map[string]any) string {
+	call := ToolCall{Tool: name}
+	if raw, err := json.Marshal(args); err == nil {
+		call.Args = string(raw)
+	}
+
+	started := time.Now()
+	tool := req.tool(name)
+	if tool == nil {
+		call.Err = fmt.Errorf("unknown tool %s", name)
+	} else {
+		call.Result, call.Err = tool.Call(args)
+	}
+	call.Duration = time.Since(started)
+
+	log.Printf("Tool call %s(%s) took %s, err: %v", call.Tool, call.Args, call.Duration, call.Err)
+	if req.OnToolCall != nil {
+		req.OnToolCall(call)
+	}
+
+	if call.Err != nil {
+		return "error: " + call.Err.Error()
+	}
+	return call.Result
+}
+
+func (r Request) tool(name string) Tool {
+	for _, tool := range r.Tools {
+		if tool.Name() == name {
+			return tool
+		}
+	}
+	return nil
+}
+
+// oaiToolResults runs the tool calls of an OpenAI compatible model and returns the tool messages with results
+func oaiToolResults(req Request, calls []openai.ToolCall) []openai.ChatCompletionMessage {
+	messages := make([]openai.ChatCompletionMessage, 0, len(calls))
+	for _, call := range calls {
+		var result string
+		var args map[string]any
+		if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil && call.Function.Arguments != "" {
+			result = "error: arguments are not valid JSON: " + err.Error()
+		} else {
+			result = callTool(req, call.Function.Name, args)
+		}
+
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:       openai.ChatMessageRoleTool,
+			ToolCallID: call.ID,
+			Content:    result,
+		})
+	}
+	return messages
+}
+
+// geminiToolResults runs the function calls of gemini and returns the content with the responses
+func geminiToolResults(req Request, calls []*genaisdk.FunctionCall) *genaisdk.Content {
+	parts := make([]*genaisdk.Part, 0, len(calls))
+	for _, call := range calls {
+		part := genaisdk.NewPartFromFunctionResponse(call.Name, map[string]any{"result": callTool(req, call.Name, call.Args)})
+		part.FunctionResponse.ID = call.ID
+		parts = append(parts, part)
+	}
+	return genaisdk.NewContentFromParts(parts, genaisdk.RoleUser)
+}
+
+// vertexToolResults runs the function calls of vertex and returns the response parts
+func vertexToolResults(req Request, calls []genai.FunctionCall) []genai.Part {
+	parts := make([]genai.Part, 0, len(calls))
+	for _, call := range calls {
+		parts = append(parts, genai.FunctionResponse{
+			Name:     call.Name,
+			Response: map[string]any{"result": callTool(req, call.Name, call.Args)},
+		})
+	}
+	return parts
+}
+
+// vertexSchema converts a JSON schema to the vertex one, vertex does not accept raw schemas
+func vertexSchema(schema map[string]any) *genai.Schema {
+	result := &genai.Schema{}
+
+	switch schema["type"] {
+	case "object":
+		result.Type = genai.TypeObject
+	case "array":
+		result.Type = genai.TypeArray
+	case "string":
+		result.Type = genai.TypeString
+	case "number":
+		result.Type = genai.TypeNumber
+	case "integer":
+		result.Type = genai.TypeInteger
+	case "boolean":
+		result.Type = genai.TypeBoolean
+	}
+
+	if description, ok := schema["description"].(string); ok {
+		result.Description = description
+	}
+	if enum, ok := schema["enum"].([]string); ok {
+		result.Enum = enum
+	}
+	if required, ok := schema["required"].([]string); ok {
+		result.Required = required
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		result.Items = vertexSchema(items)
+	}
+	if properties, ok := schema["properties"].(map[string]any); ok {
+		result.Properties = make(map[string]*genai.Schema, len(properties))
+		for name, property := range properties {
+			if property, ok := property.(map[string]any); ok {
+				result.Properties[name] = vertexSchema(property)
+			}
+		}
+	}
+
+	return result
+}
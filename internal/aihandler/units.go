@@ -0,0 +1,151 @@
+package aihandler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UnitsTool converts values between units of the same quantity
+type UnitsTool struct{}
+
+func NewUnitsTool() *UnitsTool {
+	return &UnitsTool{}
+}
+
+type unit struct {
+	quantity string
+	factor   float64 // value in the base unit of the quantity, temperatures are converted separately
+}
+
+// units maps unit names and aliases to the quantity and the factor to its base unit.
+// Base units are metre, kilogram, litre, metre per second, second, byte and square metre.
+var units = map[string]unit{
+	"mm": {"length", 0.001}, "cm": {"length", 0.01}, "m": {"length", 1}, "km": {"length", 1000},
+	"in": {"length", 0.0254}, "ft": {"length", 0.3048}, "yd": {"length", 0.9144}, "mi": {"length", 1609.344},
+	"nmi": {"length", 1852},
+
+	"mg": {"mass", 0.000001}, "g": {"mass", 0.001}, "kg": {"mass", 1}, "t": {"mass", 1000},
+	"oz": {"mass", 0.028349523125}, "lb": {"mass", 0.45359237}, "st": {"mass", 6.35029318},
+
+	"ml": {"volume", 0.001}, "l": {"volume", 1}, "m3": {"volume", 1000},
+	"tsp": {"volume", 0.00492892159375}, "tbsp": {"volume", 0.01478676478125}, "floz": {"volume", 0.0295735295625},
+	"cup": {"volume", 0.2365882365}, "pt": {"volume", 0.473176473}, "qt": {"volume", 0.946352946}, "gal": {"volume", 3.785411784},
+
+	"m/s": {"speed", 1}, "km/h": {"speed", 1 / 3.6}, "mph": {"speed", 0.44704}, "kn": {"speed", 0.514444444444},
+
+	"s": {"time", 1}, "min": {"time", 60}, "h": {"time", 3600}, "d": {"time", 86400},
+	"week": {"time", 604800}, "year": {"time", 31557600},
+
+	"b": {"data", 1}, "kb": {"data", 1e3}, "mb": {"data", 1e6}, "gb": {"data", 1e9}, "tb": {"data", 1e12},
+	"kib": {"data", 1 << 10}, "mib": {"data", 1 << 20}, "gib": {"data", 1 << 30}, "tib": {"data", 1 << 40},
+
+	"mm2": {"area", 0.000001}, "cm2": {"area", 0.0001}, "m2": {"area", 1}, "km2": {"area", 1e6},
+	"ha": {"area", 10000}, "acre": {"area", 4046.8564224}, "ft2": {"area", 0.09290304},
+
+	"c": {"temperature", 0}, "f": {"temperature", 0}, "k": {"temperature", 0},
+}
+
+// unitAliases maps spelled out names to the keys of units
+var unitAliases = map[string]string{
+	"millimeter": "mm", "centimeter": "cm", "meter": "m", "metre": "m", "kilometer": "km", "kilometre": "km",
+	"inch": "in", "inches": "in", "foot": "ft", "feet": "ft", "yard": "yd", "mile": "mi",
+	"milligram": "mg", "gram": "g", "kilogram": "kg", "ton": "t", "tonne": "t", "ounce": "oz", "pound": "lb", "stone": "st",
+	"milliliter": "ml", "liter": "l", "litre": "l", "gallon": "gal", "pint": "pt", "quart": "qt",
+	"kmh": "km/h", "kph": "km/h", "knot": "kn", "knots": "kn", "mps": "m/s",
+	"sec": "s", "second": "s", "minute": "min", "hour": "h", "day": "d", "weeks": "week", "years": "year",
+	"byte": "b", "kilobyte": "kb", "megabyte": "mb", "gigabyte": "gb", "terabyte": "tb",
+	"hectare": "ha", "acres": "acre",
+	"celsius": "c", "°c": "c", "fahrenheit": "f", "°f": "f", "kelvin": "k",
+}
+
+func (t *UnitsTool) Name() string {
+	return "convert_units"
+}
+
+func (t *UnitsTool) Description() string {
+	return "Converts a value between units of length, mass, volume, speed, time, data size, area and temperature. " +
+		"Volumes are US customary. Units: mm cm m km in ft yd mi nmi, mg g kg t oz lb st, ml l m3 tsp tbsp floz cup pt qt gal, " +
+		"m/s km/h mph kn, s min h d week year, b kb mb gb tb kib mib gib tib, mm2 cm2 m2 km2 ha acre ft2, c f k."
+}
+
+func (t *UnitsTool) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"value": map[string]any{"type": "number", "description": "value to convert"},
+			"from":  map[string]any{"type": "string", "description": "unit of the value"},
+			"to":    map[string]any{"type": "string", "description": "unit to convert to"},
+		},
+		"required": []string{"value", "from", "to"},
+	}
+}
+
+func (t *UnitsTool) Call(args map[string]any) (string, error) {
+	value, ok := args["value"].(float64)
+	if !ok {
+		return "", fmt.Errorf("value must be a number")
+	}
+	fromName, _ := args["from"].(string)
+	toName, _ := args["to"].(string)
+
+	from, err := findUnit(fromName)
+	if err != nil {
+		return "", err
+	}
+	to, err := findUnit(toName)
+	if err != nil {
+		return "", err
+	}
+	if from.quantity != to.quantity {
+		return "", fmt.Errorf("can not convert %s to %s", from.quantity, to.quantity)
+	}
+
+	var result float64
+	if from.quantity == "temperature" {
+		result = fromKelvin(toKelvin(value, unitKey(fromName)), unitKey(toName))
+	} else {
+		result = value * from.factor / to.factor
+	}
+
+	return strconv.FormatFloat(result, 'g', 10, 64) + " " + toName, nil
+}
+
+func unitKey(name string) string {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := unitAliases[key]; ok {
+		return alias
+	}
+	if alias, ok := unitAliases[strings.TrimSuffix(key, "s")]; ok {
+		return alias
+	}
+	return key
+}
+
+func findUnit(name string) (unit, error) {
+	u, ok := units[unitKey(name)]
+	if !ok {
+		return unit{}, fmt.Errorf("unknown unit %s", name)
+	}
+	return u, nil
+}
+
+func toKelvin(value float64, key string) float64 {
+	switch key {
+	case "c":
+		return value + 273.15
+	case "f":
+		return (value-32)*5/9 + 273.15
+	}
+	return value
+}
+
+func fromKelvin(value float64, key string) float64 {
+	switch key {
+	case "c":
+		return value - 273.15
+	case "f":
+		return (value-273.15)*9/5 + 32
+	}
+	return value
+}
@@ -0,0 +1,60 @@
+package aihandler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnitsCall(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     string
+	}{
+		{1, "km", "m", "1000 m"},
+		{1, "mi", "km", "1.609344 km"},
+		{12, "inches", "foot", "1 foot"},
+		{1, "lb", "g", "453.59237 g"},
+		{1, "gal", "l", "3.785411784 l"},
+		{36, "km/h", "m/s", "10 m/s"},
+		{90, "minutes", "h", "1.5 h"},
+		{1, "GiB", "MB", "1073.741824 MB"},
+		{1, "ha", "m2", "10000 m2"},
+		{100, "C", "F", "212 F"},
+		{32, "fahrenheit", "celsius", "0 celsius"},
+		{0, "K", "°C", "-273.15 °C"},
+		{-40, "c", "f", "-40 f"},
+	}
+	tool := NewUnitsTool()
+	for _, tt := range tests {
+		got, err := tool.Call(map[string]any{"value": tt.value, "from": tt.from, "to": tt.to})
+		if err != nil {
+			t.Errorf("Call(%v %s to %s) error = %v", tt.value, tt.from, tt.to, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Call(%v %s to %s) = %q, want %q", tt.value, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestUnitsCallErrors(t *testing.T) {
+	tests := []struct {
+		args map[string]any
+		want string
+	}{
+		{map[string]any{"value": 1.0, "from": "parsec", "to": "m"}, "unknown unit parsec"},
+		{map[string]any{"value": 1.0, "from": "m", "to": "furlong"}, "unknown unit furlong"},
+		{map[string]any{"value": 1.0, "from": "", "to": "m"}, "unknown unit"},
+		{map[string]any{"value": 1.0, "from": "kg", "to": "m"}, "can not convert mass to length"},
+		{map[string]any{"value": 1.0, "from": "c", "to": "s"}, "can not convert temperature to time"},
+		{map[string]any{"value": "1", "from": "m", "to": "cm"}, "value must be a number"},
+	}
+	tool := NewUnitsTool()
+	for _, tt := range tests {
+		_, err := tool.Call(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Call(%v) error = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package aihandler
+
+import (
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/sashabaranov/go-openai"
+	genaisdk "google.golang.org/genai"
+)
+
+// Usage is what the model calls of a single request consumed, tool rounds are summed up
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int // includes the thinking tokens, they are billed as output
+	CachedTokens     int // part of PromptTokens served from the provider cache
+	Images           int
+	AudioSeconds     int // transcribed audio
+	Characters       int // voiced text
+}
+
+// UsageFunc receives the usage of a request, it is called once the request is over, even if it failed
+type UsageFunc func(Usage)
+
+func (u *Usage) add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.CachedTokens += other.CachedTokens
+	u.Images += other.Images
+	u.AudioSeconds += other.AudioSeconds
+	u.Characters += other.Characters
+}
+
+func (u Usage) empty() bool {
+	return u.PromptTokens == 0 && u.CompletionTokens == 0 && u.Images == 0 && u.AudioSeconds == 0 && u.Characters == 0
+}
+
+// reportUsage passes the usage to OnUsage, calls that consumed nothing are not reported
+func (r Request) reportUsage(usage Usage) {
+	if r.OnUsage == nil || usage.empty() {
+		return
+	}
+	usage.Model = r.Model
+	r.OnUsage(usage)
+}
+
+// reportModelUsage is reportUsage for the calls made without a Request: images, transcription and speech
+func reportModelUsage(onUsage UsageFunc, model string, usage Usage) {
+	if onUsage == nil || usage.empty() {
+		return
+	}
+	usage.Model = model
+	onUsage(usage)
+}
+
+func oaiUsage(usage *openai.Usage) Usage {
+	if usage == nil {
+		return Usage{}
+	}
+	u := Usage{PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens}
+	if usage.PromptTokensDetails != nil {
+		u.CachedTokens = usage.PromptTokensDetails.CachedTokens
+	}
+	return u
+}
+
+func geminiUsage(usage *genaisdk.GenerateContentResponseUsageMetadata) Usage {
+	if usage == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:     int(usage.PromptTokenCount + usage.ToolUsePromptTokenCount),
+		CompletionTokens: int(usage.CandidatesTokenCount + usage.ThoughtsTokenCount),
+		CachedTokens:     int(usage.CachedContentTokenCount),
+	}
+}
+
+func vertexUsage(usage *genai.UsageMetadata) Usage {
+	if usage == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:     int(usage.PromptTokenCount),
+		CompletionTokens: int(usage.CandidatesTokenCount + usage.ThoughtsTokenCount),
+	}
+}
@@ -0,0 +1,247 @@
+package aihandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+)
+
+// VertexProvider talks to Gemini through Vertex AI, used when there is no Gemini API key
+type VertexProvider struct {
+	name   string
+	client *genai.Client
+	model  string
+	caps   Capabilities
+}
+
+// NewVertexProvider creates the provider for the backend model, name is the user-facing model name
+func NewVertexProvider(name string, client *genai.Client, model string, caps Capabilities) *VertexProvider {
+	return &VertexProvider{
+		name:   name,
+		client: client,
+		model:  model,
+		caps:   caps,
+	}
+}
+
+func (p *VertexProvider) Name() string {
+	return p.name
+}
+
+func (p *VertexProvider) Capabilities() Capabilities {
+	return p.caps
+}
+
+func (p *VertexProvider) Generate(ctx context.Context, req Request) (string, error) {
+	model, session, parts, err := p.session(req)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := req.context(ctx)
+	defer cancel()
+
+	var usage Usage
+	defer func() { req.reportUsage(usage) }()
+
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			vertexNoTools(model)
+		}
+
+		// a failed send leaves the parts in the session history, they are sent again from the saved one
+		history := session.History
+		var resp *genai.GenerateContentResponse
+		err := retry(ctx, p.name, func(ctx context.Context) error {
+			session.History = history
+			var err error
+			resp, err = session.SendMessage(ctx, parts...)
+			return err
+		})
+		if err != nil {
+			log.Println("Error generating content:", err)
+			return "Error generating answer: " + err.Error(), err
+		}
+		usage.add(vertexUsage(resp.UsageMetadata))
+
+		calls := vertexFunctionCalls(resp)
+		if len(calls) == 0 || round == maxToolRounds {
+			return vertexText(resp), nil
+		}
+
+		// the session keeps the calls in its history, only the results are sent
+		parts = vertexToolResults(req, calls)
+	}
+}
+
+func (p *VertexProvider) Stream(ctx context.Context, req Request, onText StreamFunc) (string, error) {
+	model, session, parts, err := p.session(req)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := req.context(ctx)
+	defer cancel()
+
+	var usage Usage
+	defer func() { req.reportUsage(usage) }()
+
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			vertexNoTools(model)
+		}
+
+		history := session.History
+		var text string
+		var calls []genai.FunctionCall
+		var roundUsage Usage
+		// the round is sent again only if nothing was shown yet
+		err := retry(ctx, p.name, func(ctx context.Context) error {
+			session.History = history
+			text, calls = "", nil
+			roundUsage = Usage{}
+			stream := session.SendMessageStream(ctx, parts...)
+			for {
+				resp, err := stream.Next()
+				if errors.Is(err, iterator.Done) {
+					return nil
+				}
+				if err != nil {
+					if text != "" {
+						return permanent(err)
+					}
+					return err
+				}
+				if resp.UsageMetadata != nil {
+					roundUsage = vertexUsage(resp.UsageMetadata)
+				}
+				calls = append(calls, vertexFunctionCalls(resp)...)
+				if chunk := vertexText(resp); chunk != "" {
+					text += chunk
+					onText(text)
+				}
+			}
+		})
+		usage.add(roundUsage)
+		if err != nil {
+			log.Println("Error generating content:", err)
+			return text, err
+		}
+
+		if len(calls) == 0 || round == maxToolRounds {
+			return text, nil
+		}
+
+		parts = vertexToolResults(req, calls)
+	}
+}
+
+// vertexContents maps the dialog to vertex contents, same rules as geminiContents
+func vertexContents(turns []Turn) []*genai.Content {
+	contents := make([]*genai.Content, 0, len(turns))
+	for i, turn := range turns {
+		role := "user"
+		if turn.Role == RoleAssistant {
+			role = "model"
+		}
+
+		var parts []genai.Part
+		if i == len(turns)-1 {
+			ytURLs, cleanedInput := extractYouTubeURLs(turn.content())
+			for _, u := range ytURLs {
+				parts = append(parts, genai.FileData{FileURI: u, MIMEType: "video/mp4"})
+			}
+			parts = append(parts, genai.Text(cleanedInput))
+		} else {
+			parts = append(parts, genai.Text(turn.content()))
+		}
+		for _, img := range turn.Images {
+			parts = append(parts, genai.Blob{MIMEType: img.MIMEType, Data: img.Data})
+		}
+
+		if len(contents) > 0 && contents[len(contents)-1].Role == role {
+			contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, &genai.Content{Role: role, Parts: parts})
+	}
+	return contents
+}
+
+// session prepares the chat session with the request history,
+// the returned parts are the last turn to be sent as the new message
+func (p *VertexProvider) session(req Request) (*genai.GenerativeModel, *genai.ChatSession, []genai.Part, error) {
+	if p.client == nil {
+		return nil, nil, nil, fmt.Errorf("model not available")
+	}
+
+	model := p.client.GenerativeModel(p.model)
+
+	model.SafetySettings = []*genai.SafetySetting{
+		{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockOnlyHigh},
+		{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockOnlyHigh},
+		{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockOnlyHigh},
+		{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockOnlyHigh},
+	}
+	model.SystemInstruction = &genai.Content{
+		Parts: []genai.Part{genai.Text(req.systemPrompt())},
+	}
+	model.SetMaxOutputTokens(int32(req.MaxTokens))
+	model.SetCandidateCount(1)
+	if len(req.Tools) > 0 {
+		declarations := make([]*genai.FunctionDeclaration, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			declarations = append(declarations, &genai.FunctionDeclaration{
+				Name:        tool.Name(),
+				Description: tool.Description(),
+				Parameters:  vertexSchema(tool.Parameters()),
+			})
+		}
+		model.Tools = []*genai.Tool{{FunctionDeclarations: declarations}}
+	}
+
+	contents := vertexContents(req.dialog())
+	if len(contents) == 0 {
+		return nil, nil, nil, fmt.Errorf("empty request")
+	}
+
+	// the chat session sends history plus the last content as the new user message
+	session := model.StartChat()
+	session.History = contents[:len(contents)-1]
+
+	return model, session, contents[len(contents)-1].Parts, nil
+}
+
+// vertexNoTools forbids further tool calls, used for the last round
+func vertexNoTools(model *genai.GenerativeModel) {
+	model.ToolConfig = &genai.ToolConfig{
+		FunctionCallingConfig: &genai.FunctionCallingConfig{Mode: genai.FunctionCallingNone},
+	}
+}
+
+func vertexText(resp *genai.GenerateContentResponse) string {
+	var respText string
+	for _, cand := range resp.Candidates {
+		if cand.Content != nil {
+			for _, part := range cand.Content.Parts {
+				if _, ok := part.(genai.Text); !ok {
+					continue
+				}
+				respText = fmt.Sprintf("%s%s", respText, part)
+			}
+		}
+	}
+	return respText
+}
+
+func vertexFunctionCalls(resp *genai.GenerateContentResponse) []genai.FunctionCall {
+	var calls []genai.FunctionCall
+	for _, cand := range resp.Candidates {
+		calls = append(calls, cand.FunctionCalls()...)
+	}
+	return calls
+}
@@ -0,0 +1,297 @@
+package cfg
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The model catalog lists the text and image models chats can use. The built-in one is compiled in,
+// MODEL_CATALOG points to a JSON file of the same format to rename or add models without a release.
+// Besides the built-in providers the catalog can declare OpenAI-compatible endpoints, a self-hosted
+// llama.cpp or Ollama server, OpenRouter and the like, text models use them by the endpoint name.
+
+//go:embed models.json
+var defaultCatalog []byte
+
+// Model providers, the backends the catalog models run on
+const (
+	ProviderOpenAI   = "openai"
+	ProviderDeepSeek = "deepseek"
+	ProviderGemini   = "gemini" // Gemini API, Vertex AI is used if there is no Gemini API key
+	ProviderVertex   = "vertex"
+)
+
+// Token parameter styles, newer OpenAI models reject max_tokens
+const (
+	TokenParamMaxTokens           = "max_tokens"
+	TokenParamMaxCompletionTokens = "max_completion_tokens"
+)
+
+// TextModel is a text model of the catalog
+type TextModel struct {
+	Alias      string `json:"alias"`       // user-facing name, stored in the chat settings
+	Backend    string `json:"backend"`     // model name sent to the API
+	Provider   string `json:"provider"`    // one of Provider* constants or an endpoint name
+	TokenParam string `json:"token_param"` // one of TokenParam* constants, max_tokens if empty
+	MaxTokens  int    `json:"max_tokens"`  // answer limit used when the bot config has none
+	MaxContext int    `json:"max_context"` // context window in tokens, 0 if unknown
+	Vision     bool   `json:"vision"`
+	Tools      bool   `json:"tools"`
+	Streaming  bool   `json:"streaming"`
+	Enabled    bool   `json:"enabled"`
+	Price      Price  `json:"price"`
+}
+
+// ImageModel is an image model of the catalog
+type ImageModel struct {
+	Alias    string `json:"alias"`
+	Backend  string `json:"backend"`
+	Provider string `json:"provider"` // openai or gemini
+	Enabled  bool   `json:"enabled"`
+	Price    Price  `json:"price"`
+}
+
+// AudioModel is a transcription or speech model, the catalog only prices them
+type AudioModel struct {
+	Alias string `json:"alias"` // the model name the usage is reported with
+	Price Price  `json:"price"`
+}
+
+// Price is what a model costs in credits, chats without a subscription pay with them.
+// Tokens and characters are priced per million, images per piece, audio per minute. The built-in
+// prices count a credit as $0.001, image models report the image as output tokens and need no image price.
+type Price struct {
+	Input       int64 `json:"input"`
+	CachedInput int64 `json:"cached_input"` // prompt tokens served from the provider cache, Input is used if 0
+	Output      int64 `json:"output"`
+	Image       int64 `json:"image"`
+	AudioMinute int64 `json:"audio_minute"` // transcribed audio
+	Characters  int64 `json:"characters"`   // voiced text
+}
+
+// Cost returns the credits of a request, a started credit counts as a whole one
+func (p Price) Cost(promptTokens int, cachedTokens int, completionTokens int, images int, audioSeconds int, characters int) int64 {
+	cachedPrice := p.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	perMillion := int64(promptTokens-cachedTokens)*p.Input + int64(cachedTokens)*cachedPrice + int64(completionTokens)*p.Output +
+		int64(characters)*p.Characters
+	perMinute := int64(audioSeconds) * p.AudioMinute
+
+	return (perMillion+999_999)/1_000_000 + (perMinute+59)/60 + int64(images)*p.Image
+}
+
+// Endpoint is an OpenAI-compatible API. The key is read from the environment so the catalog file has no secrets.
+type Endpoint struct {
+	Name      string            `json:"name"`        // used as the provider of the text models
+	BaseURL   string            `json:"base_url"`    // e.g. http://localhost:11434/v1
+	APIKeyEnv string            `json:"api_key_env"` // environment variable with the key, no key is sent if empty
+	Headers   map[string]string `json:"headers"`     // extra headers sent with every request
+}
+
+// APIKey returns the key of the endpoint from the environment
+func (e Endpoint) APIKey() string {
+	if e.APIKeyEnv == "" {
+		return ""
+	}
+	return os.Getenv(e.APIKeyEnv)
+}
+
+type Catalog struct {
+	DefaultText  string       `json:"default_text"`
+	DefaultImage string       `json:"default_image"`
+	Endpoints    []Endpoint   `json:"endpoints"`
+	Text         []TextModel  `json:"text"`
+	Image        []ImageModel `json:"image"`
+	Audio        []AudioModel `json:"audio"`
+}
+
+// LoadCatalog reads the catalog from the file, the built-in catalog is used if path is empty
+func LoadCatalog(path string) (Catalog, error) {
+	data := defaultCatalog
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return Catalog{}, err
+		}
+	}
+
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return Catalog{}, fmt.Errorf("parse model catalog: %w", err)
+	}
+	if err := catalog.validate(); err != nil {
+		return Catalog{}, err
+	}
+
+	return catalog, nil
+}
+
+func (c Catalog) validate() error {
+	endpoints := make(map[string]bool)
+	for _, endpoint := range c.Endpoints {
+		if endpoint.Name == "" || endpoint.BaseURL == "" {
+			return fmt.Errorf("endpoint needs name and base_url: %+v", endpoint)
+		}
+		switch endpoint.Name {
+		case ProviderOpenAI, ProviderDeepSeek, ProviderGemini, ProviderVertex:
+			return fmt.Errorf("endpoint name %s is a built-in provider", endpoint.Name)
+		}
+		if endpoints[endpoint.Name] {
+			return fmt.Errorf("duplicate endpoint %s", endpoint.Name)
+		}
+		endpoints[endpoint.Name] = true
+	}
+
+	seen := make(map[string]bool)
+	for _, model := range c.Text {
+		if model.Alias == "" || model.Backend == "" {
+			return fmt.Errorf("text model needs alias and backend: %+v", model)
+		}
+		if seen[model.Alias] {
+			return fmt.Errorf("duplicate text model %s", model.Alias)
+		}
+		seen[model.Alias] = true
+
+		switch model.Provider {
+		case ProviderOpenAI, ProviderDeepSeek, ProviderGemini, ProviderVertex:
+		default:
+			if !endpoints[model.Provider] {
+				return fmt.Errorf("unknown provider %s of text model %s", model.Provider, model.Alias)
+			}
+		}
+		switch model.TokenParam {
+		case "", TokenParamMaxTokens, TokenParamMaxCompletionTokens:
+		default:
+			return fmt.Errorf("unknown token_param %s of text model %s", model.TokenParam, model.Alias)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, model := range c.Image {
+		if model.Alias == "" || model.Backend == "" {
+			return fmt.Errorf("image model needs alias and backend: %+v", model)
+		}
+		if seen[model.Alias] {
+			return fmt.Errorf("duplicate image model %s", model.Alias)
+		}
+		seen[model.Alias] = true
+
+		if model.Provider != ProviderOpenAI && model.Provider != ProviderGemini {
+			return fmt.Errorf("unknown provider %s of image model %s", model.Provider, model.Alias)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, model := range c.Audio {
+		if model.Alias == "" {
+			return fmt.Errorf("audio model needs alias: %+v", model)
+		}
+		if seen[model.Alias] {
+			return fmt.Errorf("duplicate audio model %s", model.Alias)
+		}
+		seen[model.Alias] = true
+	}
+
+	if !c.IsValidAIModel(c.DefaultText) {
+		return fmt.Errorf("default text model %s is not an enabled model", c.DefaultText)
+	}
+	if !c.IsValidImageModel(c.DefaultImage) {
+		return fmt.Errorf("default image model %s is not an enabled model", c.DefaultImage)
+	}
+
+	return nil
+}
+
+// Endpoint finds the OpenAI-compatible endpoint by its name
+func (c Catalog) Endpoint(name string) (Endpoint, bool) {
+	for _, endpoint := range c.Endpoints {
+		if endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+// TextModels returns the enabled text models
+func (c Catalog) TextModels() []TextModel {
+	var models []TextModel
+	for _, model := range c.Text {
+		if model.Enabled {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// ImageModels returns the enabled image models
+func (c Catalog) ImageModels() []ImageModel {
+	var models []ImageModel
+	for _, model := range c.Image {
+		if model.Enabled {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// ImageAliases returns the names of the enabled image models
+func (c Catalog) ImageAliases() []string {
+	var aliases []string
+	for _, model := range c.ImageModels() {
+		aliases = append(aliases, model.Alias)
+	}
+	return aliases
+}
+
+// IsValidAIModel checks if the given model string is an enabled text model
+func (c Catalog) IsValidAIModel(alias string) bool {
+	_, ok := c.TextModel(alias)
+	return ok
+}
+
+// IsValidImageModel checks if the given model string is an enabled image model
+func (c Catalog) IsValidImageModel(alias string) bool {
+	_, ok := c.ImageModel(alias)
+	return ok
+}
+
+// TextModel finds the enabled text model by its alias
+func (c Catalog) TextModel(alias string) (TextModel, bool) {
+	for _, model := range c.TextModels() {
+		if model.Alias == alias {
+			return model, true
+		}
+	}
+	return TextModel{}, false
+}
+
+// Price returns the price of the text, image or audio model, false if there is no such model
+func (c Catalog) Price(alias string) (Price, bool) {
+	if model, ok := c.TextModel(alias); ok {
+		return model.Price, true
+	}
+	if model, ok := c.ImageModel(alias); ok {
+		return model.Price, true
+	}
+	for _, model := range c.Audio {
+		if model.Alias == alias {
+			return model.Price, true
+		}
+	}
+	return Price{}, false
+}
+
+// ImageModel finds the enabled image model by its alias
+func (c Catalog) ImageModel(alias string) (ImageModel, bool) {
+	for _, model := range c.ImageModels() {
+		if model.Alias == alias {
+			return model, true
+		}
+	}
+	return ImageModel{}, false
+}
@@ -2,18 +2,34 @@ package cfg
 
 import (
 	"encoding/base64"
+	"fmt"
 	"github.com/getsentry/sentry-go"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Cfg struct {
 	BotToken        string
+	BotAPIEndpoint  string // Bot API URL format like https://api.telegram.org/bot%s/%s, the official API if empty
 	OAIToken        string
+	OAIBaseURL      string // OpenAI API URL like https://api.openai.com/v1, for a proxy, the official API if empty
 	GoogleToken     string
 	GeminiDirectKey string // plain API key for google.golang.org/genai (image gen)
 	DSToken         string
+	Transcriber     string // speech-to-text backend, "openai" or "gemini"
+	ModelCatalog    string // path to the model catalog JSON, the built-in catalog is used if empty
 	DefaultAdmin    int64
+	TextTimeout     time.Duration // deadline of a text answer, including fallbacks and tool calls
+	ImageTimeout    time.Duration // deadline of an image generation
+	ShutdownGrace   time.Duration // how long the answers being generated may finish on shutdown
+	StarPlans       []Plan        // subscription periods sold for Telegram Stars, payments are off if empty
+	Reminders       Reminders
+	TrialDays       int // days new chats may use the bot before paying
+	Limits          Limits
+
+	MessageRetention time.Duration // how long chat messages are kept for history and search, forever if 0
 
 	DBHost   string
 	DBPort   string
@@ -25,6 +41,11 @@ type Cfg struct {
 
 	SentryDSN string
 	DebugMode bool
+
+	WebhookURL     string   // public URL Telegram sends the updates to, long polling is used if empty
+	WebhookSecret  string   // secret_token Telegram sends back in X-Telegram-Bot-Api-Secret-Token
+	AllowedUpdates []string // update types the bot receives, in both modes
+	HTTPPort       string   // port of the webhook and the health probes
 }
 
 // LoadConfig loads the config from the environment variables
@@ -38,10 +59,14 @@ func LoadConfig() Cfg {
 	}
 
 	cfg.BotToken = fillEnv("BOT_TOKEN")
+	cfg.BotAPIEndpoint = getEnv("BOT_API_ENDPOINT", "")
 	cfg.OAIToken = fillEnv("AI_TOKEN")
+	cfg.OAIBaseURL = getEnv("AI_BASE_URL", "")
 	cfg.DSToken = getEnv("DS_TOKEN", "")
 	cfg.GoogleToken = string(token)
 	cfg.GeminiDirectKey = getEnv("GEMINI_DIRECT_KEY", "")
+	cfg.Transcriber = getEnv("TRANSCRIBER", "openai")
+	cfg.ModelCatalog = getEnv("MODEL_CATALOG", "")
 
 	adminID, err := strconv.ParseInt(getEnv("DEFAULT_ADMIN", "438663"), 10, 64)
 	if err != nil {
@@ -50,6 +75,25 @@ func LoadConfig() Cfg {
 	}
 	cfg.DefaultAdmin = adminID
 
+	cfg.TextTimeout = getDuration("TEXT_TIMEOUT", 2*time.Minute)
+	cfg.ImageTimeout = getDuration("IMAGE_TIMEOUT", 3*time.Minute)
+	cfg.ShutdownGrace = getDuration("SHUTDOWN_GRACE", 25*time.Second)
+
+	plans, err := parsePlans(getEnv("STAR_PLANS", "30:250,90:650,365:2400"))
+	if err != nil {
+		sentry.CaptureException(err)
+		panic(err)
+	}
+	cfg.StarPlans = plans
+
+	cfg.Reminders = loadReminders()
+
+	cfg.TrialDays = getInt("TRIAL_DAYS", 3)
+
+	cfg.Limits = loadLimits()
+
+	cfg.MessageRetention = getDuration("MESSAGE_RETENTION", 30*24*time.Hour)
+
 	cfg.DBHost = fillEnv("DB_HOST")
 	cfg.DBPort = fillEnv("DB_PORT")
 	cfg.DBUser = fillEnv("DB_USER")
@@ -61,6 +105,16 @@ func LoadConfig() Cfg {
 	cfg.SentryDSN = getEnv("SENTRY_DSN", "")
 	cfg.DebugMode = getEnv("DEBUG_MODE", "false") == "true"
 
+	cfg.WebhookURL = getEnv("WEBHOOK_URL", "")
+	cfg.WebhookSecret = getEnv("WEBHOOK_SECRET", "")
+	if cfg.WebhookURL != "" && !validSecretToken(cfg.WebhookSecret) {
+		err := fmt.Errorf("WEBHOOK_SECRET: 1-256 symbols A-Z, a-z, 0-9, _ and - are required in webhook mode")
+		sentry.CaptureException(err)
+		panic(err)
+	}
+	cfg.AllowedUpdates = splitList(getEnv("ALLOWED_UPDATES", "message,callback_query,pre_checkout_query"))
+	cfg.HTTPPort = getEnv("PORT", "8080")
+
 	return cfg
 }
 
@@ -79,3 +133,180 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// getDuration parses the environment variable as a duration like 90s or 2m
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		sentry.CaptureException(err)
+		panic(err)
+	}
+	return d
+}
+
+// Plan is a subscription period sold for Telegram Stars
+type Plan struct {
+	Days  int
+	Stars int
+}
+
+// parsePlans reads the plans written as days:stars separated by commas, like 30:250,90:650
+func parsePlans(value string) ([]Plan, error) {
+	var plans []Plan
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		days, stars, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("plan %q: want days:stars", item)
+		}
+		var plan Plan
+		var err error
+		if plan.Days, err = strconv.Atoi(days); err != nil || plan.Days <= 0 {
+			return nil, fmt.Errorf("plan %q: invalid days", item)
+		}
+		if plan.Stars, err = strconv.Atoi(stars); err != nil || plan.Stars <= 0 {
+			return nil, fmt.Errorf("plan %q: invalid price", item)
+		}
+		for _, other := range plans {
+			if other.Days == plan.Days {
+				return nil, fmt.Errorf("plan %q: %d days are sold twice", item, plan.Days)
+			}
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// Reminders are the messages about the end of a chat subscription. The texts may use {chat},
+// {date} and {days}, they are replaced by the chat name, the end date and the days left.
+type Reminders struct {
+	Days            []int         // days before the end to remind at, the end itself is always reported
+	BeforeText      string        // sent the given days before the end
+	ExpiredText     string        // sent when the subscription is over
+	PaywallText     string        // the answer to a message for the bot in a chat that has not paid
+	PaywallCooldown time.Duration // the paywall answer is sent to a chat at most once in this time
+}
+
+func loadReminders() Reminders {
+	var days []int
+	for _, item := range strings.Split(getEnv("REMINDER_DAYS", "3,1"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		d, err := strconv.Atoi(item)
+		if err != nil || d <= 0 {
+			err = fmt.Errorf("REMINDER_DAYS: invalid days %q", item)
+			sentry.CaptureException(err)
+			panic(err)
+		}
+		days = append(days, d)
+	}
+
+	return Reminders{
+		Days: days,
+		BeforeText: getEnv("REMINDER_TEXT",
+			"Nafanya subscription of {chat} ends in {days} days, on {date}. Chat admins can extend it with /buy"),
+		ExpiredText: getEnv("EXPIRED_TEXT",
+			"Nafanya subscription of {chat} has ended, the bot stopped answering. Chat admins can renew it with /buy"),
+		PaywallText: getEnv("PAYWALL_TEXT",
+			"Nafanya is not paid for in this chat since {date}. Chat admins can renew the subscription with /buy or ask the bot admin"),
+		PaywallCooldown: getDuration("PAYWALL_COOLDOWN", 6*time.Hour),
+	}
+}
+
+// Rate is a token bucket, Burst requests at once and Burst more every Period. Zero Burst is no limit.
+type Rate struct {
+	Burst  int
+	Period time.Duration
+}
+
+// Limits throttle the requests to the models in a chat, chat admins are not limited.
+// Daily caps count from midnight in the chat timezone, 0 is no cap.
+type Limits struct {
+	User Rate // requests of a member in a chat
+	Chat Rate // requests of the whole chat
+
+	UserDailyText   int
+	UserDailyImages int
+	ChatDailyText   int
+	ChatDailyImages int
+}
+
+func loadLimits() Limits {
+	return Limits{
+		User:            getRate("USER_RATE", "5/1m"),
+		Chat:            getRate("CHAT_RATE", "20/1m"),
+		UserDailyText:   getInt("USER_DAILY_TEXT", 100),
+		UserDailyImages: getInt("USER_DAILY_IMAGES", 10),
+		ChatDailyText:   getInt("CHAT_DAILY_TEXT", 1000),
+		ChatDailyImages: getInt("CHAT_DAILY_IMAGES", 50),
+	}
+}
+
+// getRate parses the environment variable as burst/period like 5/1m, empty or 0 turns the limit off
+func getRate(key string, fallback string) Rate {
+	value := getEnv(key, fallback)
+	if value == "" || value == "0" {
+		return Rate{}
+	}
+	burst, period, ok := strings.Cut(value, "/")
+	var rate Rate
+	var err error
+	if ok {
+		if rate.Burst, err = strconv.Atoi(burst); err == nil {
+			rate.Period, err = time.ParseDuration(period)
+		}
+	}
+	if !ok || err != nil || rate.Burst < 0 || rate.Period <= 0 {
+		err = fmt.Errorf("%s: want burst/period like 5/1m, got %q", key, value)
+		sentry.CaptureException(err)
+		panic(err)
+	}
+	return rate
+}
+
+// getInt parses the environment variable as an integer
+func getInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		sentry.CaptureException(err)
+		panic(err)
+	}
+	return n
+}
+
+// validSecretToken checks the secret is accepted by setWebhook
+func validSecretToken(secret string) bool {
+	if secret == "" || len(secret) > 256 {
+		return false
+	}
+	for _, r := range secret {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits a comma separated value, skipping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -1,86 +1,53 @@
 package cfg
 
-// Model definitions for AI and Image generation
+// Speech model definitions, text and image models are listed in the model catalog
 
-// AIModel represents the available AI models for text generation
-type AIModel string
+// SpeechModel represents the available text-to-speech models
+type SpeechModel string
 
 const (
-	// AI Model identifiers (user-facing) - using actual model names
-	AIModelGPT55      AIModel = "gpt-5.5"
-	AIModelGemini35  AIModel = "gemini-3.5-flash"
-	AIModelDeepSeekV4 AIModel = "deepseek-v4-pro"
+	// Speech Model identifiers (user-facing) - using actual model names
+	SpeechModelGPT4oMiniTTS SpeechModel = "gpt-4o-mini-tts"
+	SpeechModelTTS1HD       SpeechModel = "tts-1-hd"
 )
 
-// GetAllAIModels returns all available AI model identifiers
-func GetAllAIModels() []AIModel {
-	return []AIModel{AIModelGPT55, AIModelGemini35, AIModelDeepSeekV4}
+// GetAllSpeechModels returns all available speech model identifiers
+func GetAllSpeechModels() []SpeechModel {
+	return []SpeechModel{SpeechModelGPT4oMiniTTS, SpeechModelTTS1HD}
 }
 
-// IsValidAIModel checks if the given model string is a valid AI model
-func IsValidAIModel(model string) bool {
-	switch AIModel(model) {
-	case AIModelGPT55, AIModelGemini35, AIModelDeepSeekV4:
+// IsValidSpeechModel checks if the given model string is a valid speech model
+func IsValidSpeechModel(model string) bool {
+	switch SpeechModel(model) {
+	case SpeechModelGPT4oMiniTTS, SpeechModelTTS1HD:
 		return true
 	default:
 		return false
 	}
 }
 
-// GetAIModelBackendName returns the actual model name for the AI backend
-// For most models, the user-facing name is the same as the backend name.
-// Note: As of 2026-06-15, gemini-3.5-pro is not yet available as an API model.
-// The current Pro-family baseline is gemini-3.1-pro-preview.
-func GetAIModelBackendName(model AIModel) string {
+// GetSpeechModelBackendName returns the actual model name for the speech backend
+func GetSpeechModelBackendName(model SpeechModel) string {
 	// User-facing names match backend names, so return as-is
 	return string(model)
 }
 
-// ImageModel represents the available image generation models
-type ImageModel string
-
-const (
-	// Image Model identifiers (user-facing) - using actual model names
-	ImageModelGPTImage2    ImageModel = "gpt-image-2"
-	ImageModelGemini31    ImageModel = "gemini-3.1-flash-image"
-)
-
-// GetAllImageModels returns all available image model identifiers
-func GetAllImageModels() []ImageModel {
-	return []ImageModel{ImageModelGPTImage2, ImageModelGemini31}
-}
-
-// IsValidImageModel checks if the given model string is a valid image model
-func IsValidImageModel(model string) bool {
-	switch ImageModel(model) {
-	case ImageModelGPTImage2, ImageModelGemini31:
-		return true
-	default:
-		return false
-	}
+// SpeechVoice returns the voice Nafanya speaks with
+func SpeechVoice() string {
+	return "onyx"
 }
 
-// GetImageModelBackendName returns the actual model name for the image backend
-// Note: The -preview suffixed image endpoints (gemini-3.1-flash-image-preview, gemini-3-pro-image-preview)
-// are deprecated and scheduled to shut down on 2026-06-25. Using GA strings instead.
-// For most models, the user-facing name is the same as the backend name.
-func GetImageModelBackendName(model ImageModel) string {
-	// User-facing names match backend names, so return as-is
-	return string(model)
+// TranscriptionModel returns the OpenAI model used for speech-to-text
+func TranscriptionModel() string {
+	return "gpt-4o-transcribe"
 }
 
-// VertexAIModel returns the Vertex AI model name for Google
-// Using gemini-3.5-flash which is the current GA flagship-class model
-func VertexAIModel() string {
+// GeminiTranscriptionModel returns the Gemini model used for speech-to-text
+func GeminiTranscriptionModel() string {
 	return "gemini-3.5-flash"
 }
 
-// DefaultAIModel returns the default AI model
-func DefaultAIModel() AIModel {
-	return AIModelGPT55
-}
-
-// DefaultImageModel returns the default image model
-func DefaultImageModel() ImageModel {
-	return ImageModelGPTImage2
+// DefaultSpeechModel returns the default speech model
+func DefaultSpeechModel() SpeechModel {
+	return SpeechModelGPT4oMiniTTS
 }
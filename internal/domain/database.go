@@ -1,10 +1,15 @@
 package domain
 
 import (
+	"errors"
 	"github.com/getsentry/sentry-go"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
+	"slices"
+	"strings"
+	"time"
 )
 
 type Handler struct {
@@ -18,7 +23,7 @@ func NewHandler(dsn string, config gorm.Option, defaultAdmin int64) (*Handler, e
 		return nil, err
 	}
 
-	err2 := db.AutoMigrate(&Chat{}, &BotConfig{})
+	err2 := db.AutoMigrate(&Chat{}, &BotConfig{}, &ChatMessage{}, &ToolCall{}, &Usage{}, &CreditTopUp{}, &Payment{}, &Reminder{}, &RateBucket{}, &DailyCount{})
 	if err2 != nil {
 		panic(err2)
 	}
@@ -38,6 +43,15 @@ func NewHandler(dsn string, config gorm.Option, defaultAdmin int64) (*Handler, e
 	return &Handler{db}, nil
 }
 
+// Close closes the connection pool
+func (h *Handler) Close() error {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
 func (h *Handler) GetAllChannelsConfig() ([]Chat, error) {
 	var channels []Chat
 	if err := h.db.Find(&channels).Error; err != nil {
@@ -60,8 +74,43 @@ func (h *Handler) CreateChannelConfig(channel Chat) error {
 	return h.db.Create(&channel).Error
 }
 
+// UpdateChannelConfig saves the chat settings. Credits and the subscription end are not touched, they change
+// only through their own methods, so a charge or a payment made meanwhile is not reverted by a stale copy of the chat.
 func (h *Handler) UpdateChannelConfig(channel Chat) error {
-	return h.db.Save(&channel).Error
+	return h.db.Omit("credits", "billed_to").Save(&channel).Error
+}
+
+// AddChatDays extends the chat subscription by days, counting from now if it is over, and returns the new end
+func (h *Handler) AddChatDays(chatID int64, days int) (time.Time, error) {
+	var billedTo time.Time
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		billedTo, err = addChatDays(tx, chatID, days)
+		return err
+	})
+
+	return billedTo, err
+}
+
+// SetBilledTo sets the end of the chat subscription
+func (h *Handler) SetBilledTo(chatID int64, billedTo time.Time) error {
+	return h.db.Model(&Chat{}).Where("id = ?", chatID).UpdateColumn("billed_to", billedTo).Error
+}
+
+// addChatDays extends the subscription inside the transaction, the chat row is locked till it ends
+func addChatDays(tx *gorm.DB, chatID int64, days int) (time.Time, error) {
+	var chat Chat
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "billed_to").First(&chat, chatID).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+	if chat.BilledTo.Before(time.Now()) {
+		chat.BilledTo = time.Now()
+	}
+	billedTo := chat.BilledTo.AddDate(0, 0, days)
+
+	err = tx.Model(&Chat{}).Where("id = ?", chatID).UpdateColumn("billed_to", billedTo).Error
+	return billedTo, err
 }
 
 func (h *Handler) GetBotConfig() (BotConfig, error) {
@@ -106,3 +155,309 @@ func (h *Handler) UpdateMaxTokens(maxTokens int) error {
 
 	return h.db.Save(&botConfig).Error
 }
+
+func (h *Handler) AddChatMessage(message ChatMessage) error {
+	return h.db.Create(&message).Error
+}
+
+// DeleteChatMessages removes the messages stored before the given time
+func (h *Handler) DeleteChatMessages(before time.Time) error {
+	return h.db.Unscoped().Where("created_at < ?", before).Delete(&ChatMessage{}).Error
+}
+
+// GetChatHistory returns up to limit latest messages of the chat in chronological order
+func (h *Handler) GetChatHistory(chatID int64, limit int) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	err := h.db.Where("chat_id = ?", chatID).
+		Order("message_id desc").
+		Limit(limit).
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(messages)
+
+	return messages, nil
+}
+
+// GetChatMessage returns the stored message, zero ChatMessage is returned if it was never stored
+func (h *Handler) GetChatMessage(chatID int64, messageID int) (ChatMessage, error) {
+	var message ChatMessage
+	err := h.db.Where("chat_id = ? AND message_id = ?", chatID, messageID).
+		Limit(1).
+		Find(&message).Error
+
+	return message, err
+}
+
+// SearchChatMessages returns up to limit latest messages of the chat containing the query, newest first
+func (h *Handler) SearchChatMessages(chatID int64, query string, limit int) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	err := h.db.Where("chat_id = ? AND text ILIKE ?", chatID, "%"+escapeLike(query)+"%").
+		Order("message_id desc").
+		Limit(limit).
+		Find(&messages).Error
+
+	return messages, err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (h *Handler) AddToolCall(call ToolCall) error {
+	return h.db.Create(&call).Error
+}
+
+func (h *Handler) AddUsage(usage Usage) error {
+	return h.db.Create(&usage).Error
+}
+
+const usageSums = "count(*) as requests, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, " +
+	"sum(cached_tokens) as cached_tokens, sum(images) as images, sum(audio_seconds) as audio_seconds, sum(characters) as characters, " +
+	"sum(cost) as cost"
+
+// GetChatUsage returns the usage of the chat since the given time by day and model, newest days first
+func (h *Handler) GetChatUsage(chatID int64, since time.Time) ([]UsageSummary, error) {
+	var summaries []UsageSummary
+	err := h.db.Model(&Usage{}).
+		Select("date_trunc('day', created_at) as day, ai_model, "+usageSums).
+		Where("chat_id = ? AND created_at >= ?", chatID, since).
+		Group("day, ai_model").
+		Order("day desc, ai_model").
+		Scan(&summaries).Error
+
+	return summaries, err
+}
+
+// GetTopChatsUsage returns up to limit chats with the most tokens used since the given time
+func (h *Handler) GetTopChatsUsage(since time.Time, limit int) ([]UsageSummary, error) {
+	var summaries []UsageSummary
+	err := h.db.Model(&Usage{}).
+		Select("chat_id, "+usageSums).
+		Where("created_at >= ?", since).
+		Group("chat_id").
+		Order("sum(prompt_tokens + completion_tokens) desc").
+		Limit(limit).
+		Scan(&summaries).Error
+
+	return summaries, err
+}
+
+// GetCredits returns the current credits of the chat
+func (h *Handler) GetCredits(chatID int64) (int64, error) {
+	var chat Chat
+	err := h.db.Select("credits").First(&chat, chatID).Error
+
+	return chat.Credits, err
+}
+
+// ChargeCredits takes the cost of a request from the chat credits, the balance may go below zero.
+// Returns the new balance.
+func (h *Handler) ChargeCredits(chatID int64, cost int64) (int64, error) {
+	var chat Chat
+	err := h.db.Model(&chat).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "credits"}}}).
+		Where("id = ?", chatID).
+		UpdateColumn("credits", gorm.Expr("credits - ?", cost)).Error
+
+	return chat.Credits, err
+}
+
+// AddCredits changes the chat credits and keeps the change in the top-up history, returns the new balance
+func (h *Handler) AddCredits(chatID int64, adminID int64, amount int64, note string) (int64, error) {
+	var balance int64
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Chat{}).
+			Where("id = ?", chatID).
+			UpdateColumn("credits", gorm.Expr("credits + ?", amount)).Error
+		if err != nil {
+			return err
+		}
+		var chat Chat
+		if err := tx.Select("credits").First(&chat, chatID).Error; err != nil {
+			return err
+		}
+		balance = chat.Credits
+
+		return tx.Create(&CreditTopUp{
+			ChatID:  chatID,
+			AdminID: adminID,
+			Amount:  amount,
+			Balance: balance,
+			Note:    note,
+		}).Error
+	})
+
+	return balance, err
+}
+
+// GetCreditTopUps returns up to limit latest credit changes of the chat, newest first
+func (h *Handler) GetCreditTopUps(chatID int64, limit int) ([]CreditTopUp, error) {
+	var topUps []CreditTopUp
+	err := h.db.Where("chat_id = ?", chatID).
+		Order("created_at desc").
+		Limit(limit).
+		Find(&topUps).Error
+
+	return topUps, err
+}
+
+// AddPayment records the payment and extends the chat subscription by its days, counting from now
+// if the subscription is over. A payment with a known charge id is not applied twice, false is returned for it.
+// Two replicas may get the same payment at once, the one losing the race on the charge id gets false too.
+func (h *Handler) AddPayment(payment Payment) (bool, error) {
+	added := false
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Payment{}).Where("charge_id = ?", payment.ChargeID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+
+		billedTo, err := addChatDays(tx, payment.ChatID, payment.Days)
+		if err != nil {
+			return err
+		}
+		payment.BilledTo = billedTo
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		added = true
+		return nil
+	})
+	if err != nil && h.duplicateKey(err) {
+		return false, nil
+	}
+
+	return added, err
+}
+
+// GetPayment returns the payment by its telegram charge id
+func (h *Handler) GetPayment(chargeID string) (Payment, error) {
+	var payment Payment
+	err := h.db.Where("charge_id = ?", chargeID).First(&payment).Error
+
+	return payment, err
+}
+
+// RefundPayment marks the payment refunded and takes its days back from the chat subscription
+func (h *Handler) RefundPayment(chargeID string, adminID int64) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		var payment Payment
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("charge_id = ?", chargeID).First(&payment).Error
+		if err != nil {
+			return err
+		}
+		if payment.RefundedAt != nil {
+			return nil
+		}
+
+		var chat Chat
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "billed_to").First(&chat, payment.ChatID).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&Chat{}).Where("id = ?", payment.ChatID).
+			UpdateColumn("billed_to", chat.BilledTo.AddDate(0, 0, -payment.Days)).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		return tx.Model(&payment).Updates(map[string]any{"refunded_at": now, "refunded_by": adminID}).Error
+	})
+}
+
+// GetChatPayments returns up to limit latest payments of the chat, newest first
+func (h *Handler) GetChatPayments(chatID int64, limit int) ([]Payment, error) {
+	var payments []Payment
+	err := h.db.Where("chat_id = ?", chatID).
+		Order("created_at desc").
+		Limit(limit).
+		Find(&payments).Error
+
+	return payments, err
+}
+
+// MarkReminder records the reminder before it is sent, false means it was sent already
+func (h *Handler) MarkReminder(chatID int64, billedTo time.Time, days int) (bool, error) {
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Reminder{
+		ChatID:   chatID,
+		BilledTo: billedTo,
+		Days:     days,
+	})
+
+	return result.RowsAffected == 1, result.Error
+}
+
+// TakeToken takes a token from the bucket that holds up to burst tokens and gets one back every refill.
+// If the bucket is empty nothing is taken and the time until the next token is returned.
+// The database clock is used so the replicas agree on the time.
+func (h *Handler) TakeToken(key string, burst int, refill time.Duration) (time.Duration, error) {
+	table := h.tableName(&RateBucket{})
+	args := map[string]any{"key": key, "burst": burst, "refill": refill.Seconds()}
+	refilled := "LEAST(@burst, b.tokens + EXTRACT(EPOCH FROM now() - b.refilled_at) / @refill)"
+
+	var taken []float64
+	err := h.db.Raw("INSERT INTO "+table+" AS b (key, tokens, refilled_at) VALUES (@key, @burst - 1, now()) "+
+		"ON CONFLICT (key) DO UPDATE SET tokens = "+refilled+" - 1, refilled_at = now() "+
+		"WHERE "+refilled+" >= 1 RETURNING b.tokens", args).Scan(&taken).Error
+	if err != nil || len(taken) > 0 {
+		return 0, err
+	}
+
+	var tokens float64
+	err = h.db.Raw("SELECT "+refilled+" FROM "+table+" AS b WHERE key = @key", args).Scan(&tokens).Error
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration((1 - tokens) * float64(refill)), nil
+}
+
+// ReturnToken puts back a token taken from the bucket, for a request another limit denied
+func (h *Handler) ReturnToken(key string, burst int) error {
+	return h.db.Model(&RateBucket{}).Where("key = ?", key).
+		UpdateColumn("tokens", gorm.Expr("LEAST(?, tokens + 1)", burst)).Error
+}
+
+// CountDaily counts a request of the key in the day, false if the key has made limit requests that day already
+func (h *Handler) CountDaily(key string, day time.Time, limit int) (bool, error) {
+	table := h.tableName(&DailyCount{})
+	result := h.db.Exec("INSERT INTO "+table+" AS c (key, day, count) VALUES (?, ?, 1) "+
+		"ON CONFLICT (key, day) DO UPDATE SET count = c.count + 1 WHERE c.count < ?",
+		key, day.Format(time.DateOnly), limit)
+
+	return result.RowsAffected == 1, result.Error
+}
+
+// UncountDaily takes back a request counted by CountDaily, for a request another limit denied
+func (h *Handler) UncountDaily(key string, day time.Time) error {
+	return h.db.Model(&DailyCount{}).Where("key = ? AND day = ? AND count > 0", key, day.Format(time.DateOnly)).
+		UpdateColumn("count", gorm.Expr("count - 1")).Error
+}
+
+// DeleteDailyCounts removes the counts of the days before the given one
+func (h *Handler) DeleteDailyCounts(before time.Time) error {
+	return h.db.Where("day < ?", before.Format(time.DateOnly)).Delete(&DailyCount{}).Error
+}
+
+// duplicateKey reports whether the error is a unique constraint violation
+func (h *Handler) duplicateKey(err error) bool {
+	if translator, ok := h.db.Dialector.(gorm.ErrorTranslator); ok {
+		err = translator.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+// tableName returns the table of the model with the configured prefix, for raw queries
+func (h *Handler) tableName(model any) string {
+	stmt := &gorm.Statement{DB: h.db}
+	if err := stmt.Parse(model); err != nil {
+		panic(err)
+	}
+	return stmt.Schema.Table
+}
@@ -0,0 +1,146 @@
+package domain
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testHandler connects to the database from TEST_DATABASE_DSN, the test is skipped without it.
+// The tables are migrated like on the bot start, so use a database of its own.
+func testHandler(t *testing.T) *Handler {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	h, err := NewHandler(dsn, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+// testChat creates a chat paid till billedTo, it is removed with its payments after the test
+func testChat(t *testing.T, h *Handler, billedTo time.Time) Chat {
+	t.Helper()
+	chat := Chat{ID: -time.Now().UnixNano(), Type: ChatTypeGroup, ChatName: t.Name(), BilledTo: billedTo}
+	if err := h.CreateChannelConfig(chat); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		h.db.Unscoped().Where("chat_id = ?", chat.ID).Delete(&Payment{})
+		h.db.Unscoped().Delete(&Chat{}, chat.ID)
+	})
+	return chat
+}
+
+func billedTo(t *testing.T, h *Handler, chatID int64) time.Time {
+	t.Helper()
+	chat, err := h.GetChannelConfig(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chat.BilledTo
+}
+
+func TestAddPaymentOnce(t *testing.T) {
+	h := testHandler(t)
+	start := time.Now().UTC().AddDate(0, 0, 10).Truncate(time.Second)
+	chat := testChat(t, h, start)
+	chargeID := "charge-" + strconv.FormatInt(-chat.ID, 10)
+
+	payment := Payment{ChatID: chat.ID, UserID: 7, Days: 30, Amount: 100, Currency: "XTR", ChargeID: chargeID}
+	added, err := h.AddPayment(payment)
+	if err != nil || !added {
+		t.Fatalf("AddPayment = %v, %v, want true, nil", added, err)
+	}
+	want := start.AddDate(0, 0, 30)
+	if got := billedTo(t, h, chat.ID); !got.Equal(want) {
+		t.Fatalf("BilledTo = %v, want %v", got, want)
+	}
+
+	added, err = h.AddPayment(payment)
+	if err != nil || added {
+		t.Fatalf("repeated AddPayment = %v, %v, want false, nil", added, err)
+	}
+	if got := billedTo(t, h, chat.ID); !got.Equal(want) {
+		t.Fatalf("BilledTo after the repeated payment = %v, want %v", got, want)
+	}
+}
+
+func TestAddPaymentConcurrent(t *testing.T) {
+	h := testHandler(t)
+	start := time.Now().UTC().AddDate(0, 0, 10).Truncate(time.Second)
+	chat := testChat(t, h, start)
+	payment := Payment{ChatID: chat.ID, UserID: 7, Days: 30, Amount: 100, Currency: "XTR",
+		ChargeID: "charge-" + strconv.FormatInt(-chat.ID, 10)}
+
+	// replicas getting the same update race on the charge id, the losers must not see an error
+	const replicas = 5
+	var wg sync.WaitGroup
+	results := make(chan bool, replicas)
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			added, err := h.AddPayment(payment)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- added
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	applied := 0
+	for added := range results {
+		if added {
+			applied++
+		}
+	}
+	if applied != 1 {
+		t.Fatalf("payment applied %d times, want once", applied)
+	}
+	if got, want := billedTo(t, h, chat.ID), start.AddDate(0, 0, 30); !got.Equal(want) {
+		t.Fatalf("BilledTo = %v, want %v", got, want)
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	h := testHandler(t)
+	start := time.Now().UTC().AddDate(0, 0, 10).Truncate(time.Second)
+	chat := testChat(t, h, start)
+	chargeID := "charge-" + strconv.FormatInt(-chat.ID, 10)
+
+	added, err := h.AddPayment(Payment{ChatID: chat.ID, UserID: 7, Days: 30, Amount: 100, Currency: "XTR", ChargeID: chargeID})
+	if err != nil || !added {
+		t.Fatalf("AddPayment = %v, %v, want true, nil", added, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.RefundPayment(chargeID, 1); err != nil {
+			t.Fatal(err)
+		}
+		// the second refund of the same payment must not take the days again
+		if got := billedTo(t, h, chat.ID); !got.Equal(start) {
+			t.Fatalf("BilledTo after refund %d = %v, want %v", i+1, got, start)
+		}
+	}
+
+	payment, err := h.GetPayment(chargeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.RefundedAt == nil || payment.RefundedBy != 1 {
+		t.Fatalf("payment is not marked refunded: %+v", payment)
+	}
+}
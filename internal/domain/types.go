@@ -14,6 +14,16 @@ const (
 
 	DefaultQuestionPrompt     = "Тебя зовут Нафаня. Ты бот-помощник в онлайн чате. Твоя задача — отвечать на вопросы участников чата {emotion}, можно материться, но не более 140 слов. Далее будет фрагмент диалога из чата. Начинай свой ответ с новой строки в роли Нафани. Не приветствуй участника чата в начале сообщения."
 	DefaultInterferencePrompt = "Тебя зовут Нафаня. Ты участник онлайн чата. Твоя задача – вклиниваться в диалог участников чата {emotion}, но не более 80 слов. Далее будет фрагмент диалога из чата. Начинай свой ответ с новой строки в роли Нафани. Не приветствуй участника чата в начале сообщения."
+
+	DefaultHistoryLength = 20
+	DefaultHistoryTokens = 2000
+	DefaultThreadDepth   = 10
+
+	VoiceRepliesOff   = "off"   // text answers only
+	VoiceRepliesVoice = "voice" // voice message instead of text
+	VoiceRepliesBoth  = "both"  // voice message in addition to text
+
+	DefaultTimezone = "Europe/Moscow"
 )
 
 type Chat struct {
@@ -30,6 +40,129 @@ type Chat struct {
 	BilledTo                 time.Time `gorm:"type:timestamp"`
 	AIModel                  string    `gorm:"type:text"`
 	ImageModel               string    `gorm:"type:text"`
+	HistoryLength            int       `gorm:"type:int;default:20"`   // how many previous messages are added to the prompt, 0 disables history
+	HistoryTokens            int       `gorm:"type:int;default:2000"` // approximate token budget for the history window
+	ThreadDepth              int       `gorm:"type:int;default:10"`   // how many replies up the thread are restored when replying to the bot
+	AutoTranscribe           bool      `gorm:"type:bool"`             // reply to every voice message with its transcript
+	VoiceReplies             string    `gorm:"type:varchar(10)"`      // off, voice or both, see VoiceReplies* constants
+	SpeechModel              string    `gorm:"type:text"`
+	StreamAnswers            bool      `gorm:"type:bool"` // show answers while they are generated by editing the message
+	AnswerFileThreshold      int       `gorm:"type:int"`  // answers longer than this many symbols are sent as a .md file, 0 disables
+
+	DisabledTools pq.StringArray `gorm:"type:text[]"`      // names of the tools the model may not call, all tools are enabled by default
+	Timezone      string         `gorm:"type:varchar(64)"` // IANA timezone for the date tool, empty means DefaultTimezone
+
+	LinkAllowDomains pq.StringArray `gorm:"type:text[]"` // links are read only from these domains, empty allows all
+	LinkDenyDomains  pq.StringArray `gorm:"type:text[]"` // links from these domains are never read
+
+	FallbackModels  pq.StringArray `gorm:"type:text[]"` // models tried in order when the chat model fails
+	ShowAnswerModel bool           `gorm:"type:bool"`   // add the name of the model that answered to the answer
+
+	// Credits pay for the requests once BilledTo has passed. They change only through
+	// AddCredits and ChargeCredits, UpdateChannelConfig leaves them and BilledTo as they are.
+	Credits int64 `gorm:"type:bigint;default:0"`
+}
+
+// ChatMessage is a single message seen or sent by the bot, used to build conversation history
+type ChatMessage struct {
+	gorm.Model
+	ChatID    int64  `gorm:"index:idx_chat_message,priority:1"`
+	MessageID int    `gorm:"index:idx_chat_message,priority:2"`
+	ReplyToID int    `gorm:"type:int"` // id of the parent message, 0 if the message is not a reply
+	UserID    int64  `gorm:"type:bigint"`
+	UserName  string `gorm:"type:varchar(255)"`
+	IsBot     bool   `gorm:"type:bool"`
+	Text      string `gorm:"type:text"`
+
+	Transcribed bool `gorm:"type:bool"` // Text has the transcript of the voice message, not just its caption
+}
+
+// ToolCall is a tool invocation made by the model while answering, kept for debugging
+type ToolCall struct {
+	gorm.Model
+	ChatID     int64  `gorm:"index"`
+	UserID     int64  `gorm:"type:bigint"`
+	Tool       string `gorm:"type:varchar(64)"`
+	Arguments  string `gorm:"type:text"`
+	Result     string `gorm:"type:text"`
+	Error      string `gorm:"type:text"`
+	DurationMS int64  `gorm:"type:bigint"`
+}
+
+// Usage is what a single request to a model consumed, text answers and images alike
+type Usage struct {
+	gorm.Model
+	ChatID           int64  `gorm:"index"`
+	UserID           int64  `gorm:"type:bigint"`
+	AIModel          string `gorm:"type:text"`
+	PromptTokens     int    `gorm:"type:int"`
+	CompletionTokens int    `gorm:"type:int"`
+	CachedTokens     int    `gorm:"type:int"` // part of the prompt tokens served from the provider cache
+	Images           int    `gorm:"type:int"`
+	AudioSeconds     int    `gorm:"type:int"`    // transcribed audio
+	Characters       int    `gorm:"type:int"`    // voiced text
+	Cost             int64  `gorm:"type:bigint"` // credits by the catalog prices, charged only if the chat paid with credits
+}
+
+// CreditTopUp is a change of the chat credits made by a bot admin
+type CreditTopUp struct {
+	gorm.Model
+	ChatID  int64  `gorm:"index"`
+	AdminID int64  `gorm:"type:bigint"`
+	Amount  int64  `gorm:"type:bigint"` // negative for corrections
+	Balance int64  `gorm:"type:bigint"` // credits after the change
+	Note    string `gorm:"type:text"`
+}
+
+// Payment is a subscription period bought with Telegram Stars
+type Payment struct {
+	gorm.Model
+	ChatID     int64      `gorm:"index"`
+	UserID     int64      `gorm:"type:bigint"` // who paid, refunds go back to this user
+	Days       int        `gorm:"type:integer"`
+	Amount     int        `gorm:"type:integer"` // in Stars
+	Currency   string     `gorm:"type:varchar(8)"`
+	ChargeID   string     `gorm:"type:varchar(255);uniqueIndex"` // telegram_payment_charge_id
+	BilledTo   time.Time  // the chat subscription end right after the payment
+	RefundedAt *time.Time // nil if not refunded
+	RefundedBy int64      `gorm:"type:bigint"`
+}
+
+// Reminder is a reminder about the end of the chat subscription that was sent, one per end date and offset
+type Reminder struct {
+	gorm.Model
+	ChatID   int64     `gorm:"uniqueIndex:idx_reminder_once"`
+	BilledTo time.Time `gorm:"type:timestamp;uniqueIndex:idx_reminder_once"` // the subscription end the reminder is about
+	Days     int       `gorm:"type:int;uniqueIndex:idx_reminder_once"`       // days before the end, 0 for the end itself
+}
+
+// RateBucket is a token bucket of the request limits, kept in the database so all replicas share it
+type RateBucket struct {
+	Key        string    `gorm:"primaryKey;type:varchar(100)"`
+	Tokens     float64   `gorm:"type:double precision"`
+	RefilledAt time.Time `gorm:"type:timestamptz"`
+}
+
+// DailyCount is the number of requests of a user or a chat in a day, for the daily caps
+type DailyCount struct {
+	Key   string    `gorm:"primaryKey;type:varchar(100)"`
+	Day   time.Time `gorm:"primaryKey;type:date"`
+	Count int       `gorm:"type:int"`
+}
+
+// UsageSummary is the usage summed up over a group of requests, the grouping fields that were not used are zero
+type UsageSummary struct {
+	Day              time.Time
+	AIModel          string
+	ChatID           int64
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+	CachedTokens     int64
+	Images           int64
+	AudioSeconds     int64
+	Characters       int64
+	Cost             int64
 }
 
 type BotConfig struct {
@@ -50,5 +183,8 @@ func GetDefaultChat() Chat {
 		AgroLevel:                5,
 		AgroCooldown:             10,
 		BilledTo:                 time.Now(),
+		HistoryLength:            DefaultHistoryLength,
+		HistoryTokens:            DefaultHistoryTokens,
+		ThreadDepth:              DefaultThreadDepth,
 	}
 }
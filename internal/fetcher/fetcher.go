@@ -0,0 +1,214 @@
+// Package fetcher downloads web pages shared in chats and extracts their readable text for prompts.
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	DefaultTimeout  = 10 * time.Second
+	DefaultMaxBytes = 2 << 20 // pages are cut after 2 MiB, article text is always at the beginning
+	DefaultMaxText  = 6000    // runes of extracted text, longer text is truncated
+
+	userAgent = "Mozilla/5.0 (compatible; NafanyaBot/1.0; +https://t.me/nafanya_bot)"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported content type")
+	ErrForbiddenHost   = errors.New("host is not allowed")
+)
+
+// Page is the readable part of a fetched page
+type Page struct {
+	URL   string
+	Title string
+	Text  string
+}
+
+// Fetcher downloads pages with size and time limits
+type Fetcher struct {
+	client   *http.Client
+	timeout  time.Duration
+	maxBytes int64
+	maxText  int
+}
+
+// NewFetcher creates a fetcher using the given client. With nil the default client is used,
+// it refuses to connect to private and loopback addresses, so users can not make the bot
+// read the internal network.
+func NewFetcher(client *http.Client) *Fetcher {
+	if client == nil {
+		client = publicClient()
+	}
+
+	return &Fetcher{
+		client:   client,
+		timeout:  DefaultTimeout,
+		maxBytes: DefaultMaxBytes,
+		maxText:  DefaultMaxText,
+	}
+}
+
+// SetLimits overrides the default limits, zero values keep the current ones
+func (f *Fetcher) SetLimits(timeout time.Duration, maxBytes int64, maxText int) {
+	if timeout > 0 {
+		f.timeout = timeout
+	}
+	if maxBytes > 0 {
+		f.maxBytes = maxBytes
+	}
+	if maxText > 0 {
+		f.maxText = maxText
+	}
+}
+
+// Fetch downloads the page and returns its title and text. HTML is reduced to the readable text,
+// plain text is returned as is, other content types are rejected with ErrUnsupportedType.
+// The download is stopped when ctx is done or the fetcher timeout passes.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (Page, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return Page{}, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,text/plain;q=0.9")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Page{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Page{}, fmt.Errorf("fetch %s: %s", rawURL, resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil && contentType != "" {
+		return Page{}, ErrUnsupportedType
+	}
+	if contentType == "" {
+		mediaType = "text/html"
+	}
+
+	// pages are often in cp1251 or koi8-r, the reader converts them to utf-8
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.maxBytes), contentType)
+	if err != nil {
+		return Page{}, err
+	}
+
+	page := Page{URL: resp.Request.URL.String()}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		page.Title, page.Text, err = extractText(body)
+	case "text/plain", "text/markdown":
+		var raw []byte
+		raw, err = io.ReadAll(body)
+		page.Text = strings.TrimSpace(string(raw))
+	default:
+		return Page{}, ErrUnsupportedType
+	}
+	if err != nil {
+		return Page{}, err
+	}
+
+	page.Text = truncate(page.Text, f.maxText)
+
+	return page, nil
+}
+
+func truncate(text string, limit int) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	return string([]rune(text)[:limit]) + "…"
+}
+
+// DomainAllowed checks the host against allow and deny lists. A domain matches itself and its subdomains.
+// An empty allow list allows every domain that is not denied.
+func DomainAllowed(rawURL string, allow []string, deny []string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+
+	for _, domain := range deny {
+		if matchDomain(host, domain) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, domain := range allow {
+		if matchDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(host string, domain string) bool {
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// publicClient returns the client that can only connect to public addresses.
+// The check is done on the dialed address, so redirects and DNS tricks are covered too.
+func publicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: DefaultTimeout,
+		Control: func(_ string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if forbiddenIP(net.ParseIP(host)) {
+				return ErrForbiddenHost
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   DefaultTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, cloud providers use it for internal services
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// forbiddenIP reports whether the address is not a public one
+func forbiddenIP(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
@@ -0,0 +1,180 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, contentType string, body []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDefaultClientRefusesLocalServer(t *testing.T) {
+	server := serve(t, "text/plain", []byte("internal"))
+
+	_, err := NewFetcher(nil).Fetch(context.Background(), server.URL)
+	if !errors.Is(err, ErrForbiddenHost) {
+		t.Fatalf("Fetch(%s) error = %v, want ErrForbiddenHost", server.URL, err)
+	}
+}
+
+func TestForbiddenIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"0.0.0.0", true},
+		{"fd00::1", true},
+		{"224.0.0.1", true},
+		{"100.128.0.1", false},
+		{"8.8.8.8", false},
+		{"2a00:1450:4010:c0e::8a", false},
+	}
+	for _, tt := range tests {
+		if got := forbiddenIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("forbiddenIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if !forbiddenIP(nil) {
+		t.Error("forbiddenIP(nil) = false, want true")
+	}
+}
+
+func TestFetchHTML(t *testing.T) {
+	server := serve(t, "text/html; charset=utf-8", []byte(`<html><head><title>Site | Title</title>
+<meta property="og:title" content="Article title"><script>var x = 1;</script></head>
+<body><nav>Menu</nav><article><h1>Header</h1><p>First   paragraph.</p><p>Second</p></article>
+<footer>Footer</footer></body></html>`))
+
+	page, err := NewFetcher(server.Client()).Fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Title != "Article title" {
+		t.Errorf("Title = %q, want %q", page.Title, "Article title")
+	}
+	if want := "Header\nFirst paragraph.\nSecond"; page.Text != want {
+		t.Errorf("Text = %q, want %q", page.Text, want)
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	server := serve(t, "text/plain", []byte(strings.Repeat("a", 100)+strings.Repeat("b", 100)))
+
+	f := NewFetcher(server.Client())
+	f.SetLimits(0, 100, 0)
+	page, err := f.Fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("a", 100); page.Text != want {
+		t.Errorf("Text = %q, want the first 100 bytes", page.Text)
+	}
+}
+
+func TestFetchTextLimit(t *testing.T) {
+	server := serve(t, "text/plain; charset=utf-8", []byte("привет мир"))
+
+	f := NewFetcher(server.Client())
+	f.SetLimits(0, 0, 6)
+	page, err := f.Fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "привет…"; page.Text != want {
+		t.Errorf("Text = %q, want %q", page.Text, want)
+	}
+}
+
+func TestFetchCharset(t *testing.T) {
+	// "Привет" in windows-1251
+	body := []byte{0xCF, 0xF0, 0xE8, 0xE2, 0xE5, 0xF2}
+
+	for _, contentType := range []string{"text/plain; charset=windows-1251", "text/html; charset=windows-1251"} {
+		server := serve(t, contentType, body)
+
+		page, err := NewFetcher(server.Client()).Fetch(context.Background(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Text != "Привет" {
+			t.Errorf("%s: Text = %q, want %q", contentType, page.Text, "Привет")
+		}
+	}
+}
+
+func TestFetchUnsupportedType(t *testing.T) {
+	server := serve(t, "application/pdf", []byte("%PDF-1.4"))
+
+	_, err := NewFetcher(server.Client()).Fetch(context.Background(), server.URL)
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("Fetch error = %v, want ErrUnsupportedType", err)
+	}
+}
+
+func TestDomainAllowed(t *testing.T) {
+	tests := []struct {
+		url   string
+		allow []string
+		deny  []string
+		want  bool
+	}{
+		{"https://example.com/page", nil, nil, true},
+		{"https://example.com/page", nil, []string{"example.com"}, false},
+		{"https://news.example.com/page", nil, []string{"example.com"}, false},
+		{"https://notexample.com/page", nil, []string{"example.com"}, true},
+		{"https://EXAMPLE.com/page", nil, []string{" .Example.COM "}, false},
+		{"https://example.com/page", []string{"example.com"}, nil, true},
+		{"https://blog.example.com/page", []string{"example.com"}, nil, true},
+		{"https://other.org/page", []string{"example.com"}, nil, false},
+		{"https://ads.example.com/page", []string{"example.com"}, []string{"ads.example.com"}, false},
+		{"https://example.com:8080/page", []string{"example.com"}, nil, true},
+		{"not a url", nil, nil, false},
+		{"https:///path", nil, nil, false},
+	}
+	for _, tt := range tests {
+		if got := DomainAllowed(tt.url, tt.allow, tt.deny); got != tt.want {
+			t.Errorf("DomainAllowed(%q, %v, %v) = %v, want %v", tt.url, tt.allow, tt.deny, got, tt.want)
+		}
+	}
+}
+
+func TestFetchCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NewFetcher(server.Client()).Fetch(ctx, server.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Fetch error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed >= DefaultTimeout {
+		t.Errorf("Fetch took %s, want it stopped with the context", elapsed)
+	}
+}
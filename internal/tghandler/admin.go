@@ -3,7 +3,6 @@ package tghandler
 import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/shabablinchikow/nafanya-bot/internal/domain"
-	"golang.org/x/exp/slices"
 )
 
 func (h *Handler) isAdmin(id int64) bool {
@@ -16,15 +15,24 @@ func (h *Handler) isAdmin(id int64) bool {
 	return false
 }
 
-func (h *Handler) isChatAdmin(update tgbotapi.Update) bool {
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == update.Message.Chat.ID
+// isCallbackAdmin checks the user pressing a button is an admin of the chat the button was attached to
+func (h *Handler) isCallbackAdmin(cb *tgbotapi.CallbackQuery) bool {
+	if cb.Message.Chat.Type == "private" {
+		return true
+	}
+	member, err := h.bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: cb.Message.Chat.ID, UserID: cb.From.ID},
 	})
-	if idx == -1 {
+	return err == nil && (member.Status == "administrator" || member.Status == "creator")
+}
+
+func (h *Handler) isChatAdmin(update tgbotapi.Update) bool {
+	chat, ok := h.getChat(update.Message.Chat.ID)
+	if !ok {
 		return false
 	}
 
-	if h.chats[idx].Type == domain.ChatTypePrivate {
+	if chat.Type == domain.ChatTypePrivate {
 		return true
 	}
 
@@ -2,39 +2,33 @@ package tghandler
 
 import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/shabablinchikow/nafanya-bot/internal/domain"
-	"golang.org/x/exp/slices"
 	"time"
 )
 
 func (h *Handler) checkAllowed(id int64) bool {
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == id
-	})
-
-	if idx == -1 || h.chats[idx].BilledTo.Before(time.Now()) {
+	chat, ok := h.getChat(id)
+	if !ok {
 		return false
 	}
+	if !chat.BilledTo.Before(time.Now()) {
+		return true
+	}
 
-	return true
+	// the subscription is over, the chat may still pay with credits
+	return chat.Credits > 0
 }
 
 func (h *Handler) checkChatExists(chat *tgbotapi.Chat) bool {
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == chat.ID
-	})
+	_, ok := h.getChat(chat.ID)
 
-	return idx != -1
+	return ok
 }
 
 func (h *Handler) isDeletePreview(chat *tgbotapi.Chat) bool {
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == chat.ID
-	})
-
-	if idx == -1 {
+	channel, ok := h.getChat(chat.ID)
+	if !ok {
 		return false
 	}
 
-	return h.chats[idx].DeletePreviewMessages
+	return channel.DeletePreviewMessages
 }
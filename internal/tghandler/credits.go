@@ -0,0 +1,174 @@
+package tghandler
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	creditHistoryLimit = 10
+	creditSpendDays    = 7
+)
+
+// paysWithCredits reports whether the requests of the chat are paid with credits, the subscription is over
+func (h *Handler) paysWithCredits(chatID int64) bool {
+	chat, ok := h.getChat(chatID)
+	return ok && chat.BilledTo.Before(time.Now())
+}
+
+// usageCost prices the usage of the model by the catalog, unknown models cost nothing
+func (h *Handler) usageCost(usage aihandler.Usage) int64 {
+	price, ok := h.getCatalog().Price(usage.Model)
+	if !ok {
+		log.Println("No price for model", usage.Model)
+		return 0
+	}
+	return price.Cost(usage.PromptTokens, usage.CachedTokens, usage.CompletionTokens, usage.Images, usage.AudioSeconds, usage.Characters)
+}
+
+// chargeCredits takes the cost from the chat credits if the chat pays with them
+func (h *Handler) chargeCredits(chatID int64, cost int64) {
+	if cost == 0 || !h.paysWithCredits(chatID) {
+		return
+	}
+	balance, err := h.db.ChargeCredits(chatID, cost)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+	h.setCachedCredits(chatID, balance)
+}
+
+// setCachedCredits keeps the balance of the cached chat in step with the database, checkAllowed reads it
+func (h *Handler) setCachedCredits(chatID int64, balance int64) {
+	h.chatsMux.Lock()
+	defer h.chatsMux.Unlock()
+
+	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
+		return channel.ID == chatID
+	})
+	if idx != -1 {
+		h.chats[idx].Credits = balance
+	}
+}
+
+// chatAddCredits tops up the chat credits, a negative amount takes them away
+func (h *Handler) chatAddCredits(update tgbotapi.Update) {
+	if !h.isAdmin(update.Message.From.ID) {
+		return
+	}
+
+	args := strings.SplitN(strings.TrimSpace(update.Message.CommandArguments()), " ", 3)
+	if len(args) < 2 {
+		h.sendMessage(update, "Wrong number of arguments, use /chatAddCredits <chat id> <credits> [note]")
+		return
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		h.sendMessage(update, "Invalid chat id")
+		return
+	}
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount == 0 {
+		h.sendMessage(update, "Invalid amount of credits")
+		return
+	}
+	var note string
+	if len(args) == 3 {
+		note = args[2]
+	}
+
+	if _, ok := h.getChat(id); !ok {
+		h.sendMessage(update, "Unknown chat")
+		return
+	}
+
+	balance, err := h.db.AddCredits(id, update.Message.From.ID, amount, note)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		h.sendMessage(update, "Credits are not added: "+err.Error())
+		return
+	}
+	h.setCachedCredits(id, balance)
+
+	h.sendMessage(update, "Done, balance: "+strconv.FormatInt(balance, 10))
+}
+
+// chatCredits shows the chat balance, latest top-ups and the spending of the last days
+func (h *Handler) chatCredits(update tgbotapi.Update) {
+	if !h.isAdmin(update.Message.From.ID) {
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(update.Message.CommandArguments()), 10, 64)
+	if err != nil {
+		h.sendMessage(update, "Invalid chat id, use /chatCredits <chat id>")
+		return
+	}
+
+	balance, err := h.db.GetCredits(id)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		h.sendMessage(update, "Unknown chat")
+		return
+	}
+	topUps, err := h.db.GetCreditTopUps(id, creditHistoryLimit)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+	usage, err := h.db.GetChatUsage(id, time.Now().AddDate(0, 0, -creditSpendDays))
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+
+	message := "Credits: " + strconv.FormatInt(balance, 10)
+	if h.paysWithCredits(id) {
+		message += "\nSubscription is over, requests are paid with credits"
+	}
+
+	message += "\n\nTop-ups:"
+	if len(topUps) == 0 {
+		message += "\nnone"
+	}
+	for _, topUp := range topUps {
+		message += "\n" + topUp.CreatedAt.Format("2006-01-02 15:04") + " " + strconv.FormatInt(topUp.Amount, 10) +
+			" → " + strconv.FormatInt(topUp.Balance, 10)
+		if topUp.Note != "" {
+			message += " (" + topUp.Note + ")"
+		}
+	}
+
+	// cost is counted for subscribed chats too, it is charged only when the chat pays with credits
+	message += "\n\nCost of the last " + strconv.Itoa(creditSpendDays) + " days:"
+	if len(usage) == 0 {
+		message += "\nnone"
+	}
+	var day time.Time
+	var dayCost int64
+	for i, summary := range usage {
+		if !summary.Day.Equal(day) {
+			day, dayCost = summary.Day, 0
+		}
+		dayCost += summary.Cost
+		if i == len(usage)-1 || !usage[i+1].Day.Equal(day) {
+			message += "\n" + day.Format("2006-01-02") + " " + strconv.FormatInt(dayCost, 10)
+		}
+	}
+
+	h.sendMessage(update, message)
+}
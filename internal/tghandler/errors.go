@@ -0,0 +1,31 @@
+package tghandler
+
+import (
+	"errors"
+
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+)
+
+// aiErrors are the user messages of the provider error classes, the first match wins
+var aiErrors = []struct {
+	err     error
+	message string
+}{
+	{aihandler.ErrSafetyBlocked, "The model refused to answer, its safety filter blocked the request"},
+	{aihandler.ErrRateLimited, "The model is overloaded with requests, try again in a minute"},
+	{aihandler.ErrTimeout, "The model did not answer in time, try again"},
+	{aihandler.ErrUnavailable, "The model is unavailable right now, try again later or pick another one in /chatConfigure"},
+	{aihandler.ErrQuotaExceeded, "The model is out of quota, the bot admin has to check the provider balance"},
+	{aihandler.ErrAuth, "The model rejected the bot credentials, the bot admin has to check the API keys"},
+}
+
+// aiErrorText turns the error of a model call into the message for the chat.
+// Errors of unknown kind are shown with the header and the raw error.
+func aiErrorText(err error, header string) string {
+	for _, known := range aiErrors {
+		if errors.Is(err, known.err) {
+			return known.message
+		}
+	}
+	return header + "\n```\n" + err.Error() + "\n```"
+}
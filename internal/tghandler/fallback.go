@@ -0,0 +1,36 @@
+package tghandler
+
+import (
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+// chatFallbacks returns the models tried after the chat model fails
+func (h *Handler) chatFallbacks(chatID int64) []string {
+	chat, _ := h.getChat(chatID)
+	return chat.FallbackModels
+}
+
+// chatVision reports whether the chat model or one of its fallbacks can look at images
+func (h *Handler) chatVision(chat domain.Chat) bool {
+	for _, model := range append([]string{h.chatModel(chat.AIModel)}, chat.FallbackModels...) {
+		if caps, _ := h.ai.Capabilities(model); caps.Vision {
+			return true
+		}
+	}
+	return false
+}
+
+// annotateModel adds the name of the model that answered if the chat asked for it.
+// Spoken answers are left as is, the name would be read aloud.
+func (h *Handler) annotateModel(chatID int64, answer string, model string, voiceAsked bool) string {
+	chat, _ := h.getChat(chatID)
+	if !chat.ShowAnswerModel || voiceAsked || (chat.VoiceReplies != "" && chat.VoiceReplies != domain.VoiceRepliesOff) {
+		return answer
+	}
+	return answer + "\n\n*" + model + "*"
+}
+
+// fallbacksText lists the fallback models of the chat for the config message
+func fallbacksText(chat domain.Chat) string {
+	return domainsText(chat.FallbackModels, "none")
+}
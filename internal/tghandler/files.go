@@ -0,0 +1,109 @@
+package tghandler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+)
+
+const (
+	// maxFileSize is the Bot API download limit
+	maxFileSize = 20 << 20
+
+	noVisionMessage = "Текущая модель не умеет смотреть картинки, выбери другую в /chatConfigure"
+)
+
+var fileClient = &http.Client{Timeout: 60 * time.Second}
+
+// downloadFile downloads the file from telegram servers through the Bot API file endpoint
+func (h *Handler) downloadFile(fileID string) ([]byte, error) {
+	url, err := h.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fileClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file download failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFileSize {
+		return nil, fmt.Errorf("file is too big")
+	}
+
+	return data, nil
+}
+
+// messageText returns the message text or the caption for media messages
+func messageText(message *tgbotapi.Message) string {
+	if message.Text != "" {
+		return message.Text
+	}
+	return message.Caption
+}
+
+// photoFileID returns the file id of the image in the message, empty if there is none.
+// Images sent as files are counted too.
+func photoFileID(message *tgbotapi.Message) (fileID string, mimeType string) {
+	if len(message.Photo) > 0 {
+		// sizes are sorted, the last one is the original
+		return message.Photo[len(message.Photo)-1].FileID, "image/jpeg"
+	}
+	if message.Document != nil && strings.HasPrefix(message.Document.MimeType, "image/") {
+		return message.Document.FileID, message.Document.MimeType
+	}
+	return "", ""
+}
+
+// hasPhoto reports whether the message or the message it replies to has an image
+func hasPhoto(message *tgbotapi.Message) bool {
+	if id, _ := photoFileID(message); id != "" {
+		return true
+	}
+	if message.ReplyToMessage != nil {
+		if id, _ := photoFileID(message.ReplyToMessage); id != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// messageImages downloads images of the message and the message it replies to
+func (h *Handler) messageImages(message *tgbotapi.Message) []aihandler.Image {
+	var images []aihandler.Image
+	for _, m := range []*tgbotapi.Message{message.ReplyToMessage, message} {
+		if m == nil {
+			continue
+		}
+		fileID, mimeType := photoFileID(m)
+		if fileID == "" {
+			continue
+		}
+
+		data, err := h.downloadFile(fileID)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			continue
+		}
+		images = append(images, aihandler.Image{Data: data, MIMEType: mimeType})
+	}
+
+	return images
+}
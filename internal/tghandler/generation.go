@@ -0,0 +1,92 @@
+package tghandler
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	defaultTextTimeout  = 2 * time.Minute
+	defaultImageTimeout = 3 * time.Minute
+)
+
+// stopWords stop the generation when sent in reply to the bot
+var stopWords = []string{"стоп", "stop", "хватит"}
+
+// SetTimeouts sets the deadlines of text and image generation, zero keeps the default
+func (h *Handler) SetTimeouts(text time.Duration, image time.Duration) {
+	if text > 0 {
+		h.textTimeout = text
+	}
+	if image > 0 {
+		h.imageTimeout = image
+	}
+}
+
+// startGeneration returns the context for a model call in the chat. It is done after the timeout,
+// on /stop in the chat and on shutdown. done must be called when the call is over.
+func (h *Handler) startGeneration(chatID int64, timeout time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithTimeout(h.ctx, timeout)
+
+	h.generationsMux.Lock()
+	h.generationID++
+	id := h.generationID
+	if h.generations[chatID] == nil {
+		h.generations[chatID] = make(map[uint64]context.CancelFunc)
+	}
+	h.generations[chatID][id] = cancel
+	h.generationsMux.Unlock()
+
+	return ctx, func() {
+		h.generationsMux.Lock()
+		delete(h.generations[chatID], id)
+		if len(h.generations[chatID]) == 0 {
+			delete(h.generations, chatID)
+		}
+		h.generationsMux.Unlock()
+		cancel()
+	}
+}
+
+// stopGenerations cancels the model calls running in the chat, returns how many were stopped
+func (h *Handler) stopGenerations(chatID int64) int {
+	h.generationsMux.Lock()
+	defer h.generationsMux.Unlock()
+
+	running := h.generations[chatID]
+	for _, cancel := range running {
+		cancel()
+	}
+	delete(h.generations, chatID)
+
+	return len(running)
+}
+
+// stopGeneration handles /stop and the stop words sent in reply to the bot
+func (h *Handler) stopGeneration(update tgbotapi.Update) {
+	if stopped := h.stopGenerations(update.Message.Chat.ID); stopped > 0 {
+		h.sendMessage(update, "Stopped: "+strconv.Itoa(stopped))
+		return
+	}
+	h.sendMessage(update, "Nothing to stop")
+}
+
+// isStopReply reports whether the message is a stop word in reply to the bot
+func (h *Handler) isStopReply(update tgbotapi.Update) bool {
+	reply := update.Message.ReplyToMessage
+	if reply == nil || reply.From == nil || reply.From.ID != h.bot.Self.ID {
+		return false
+	}
+
+	text := strings.ToLower(strings.Trim(update.Message.Text, " !.\n"))
+	for _, word := range stopWords {
+		if text == word {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package tghandler
+
+import (
+	"context"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+	"golang.org/x/exp/slices"
+)
+
+// approxCharsPerToken is a rough average for mixed russian/english chat text,
+// good enough to keep the history window inside the budget without a real tokenizer
+const approxCharsPerToken = 3
+
+func estimateTokens(text string) int {
+	return utf8.RuneCountInString(text)/approxCharsPerToken + 1
+}
+
+// authorName returns the name used for the message author in prompts
+func authorName(user *tgbotapi.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.IsBot {
+		return user.FirstName
+	}
+	return user.FirstName + " " + user.LastName
+}
+
+// messageTurn converts a telegram message to a conversation turn,
+// the bot's own messages become assistant turns
+func (h *Handler) messageTurn(message *tgbotapi.Message) aihandler.Turn {
+	if message.From != nil && message.From.ID == h.bot.Self.ID {
+		return aihandler.Turn{Role: aihandler.RoleAssistant, Text: messageText(message)}
+	}
+	return aihandler.Turn{Role: aihandler.RoleUser, Name: authorName(message.From), Text: messageText(message)}
+}
+
+// historyTurn converts a stored message to a conversation turn
+func (h *Handler) historyTurn(message domain.ChatMessage) aihandler.Turn {
+	if message.IsBot && message.UserID == h.bot.Self.ID {
+		return aihandler.Turn{Role: aihandler.RoleAssistant, Text: message.Text}
+	}
+	return aihandler.Turn{Role: aihandler.RoleUser, Name: message.UserName, Text: message.Text}
+}
+
+// getChat returns a copy of the cached chat, the cache is replaced by reloadChannels at any time
+func (h *Handler) getChat(id int64) (domain.Chat, bool) {
+	h.chatsMux.RLock()
+	defer h.chatsMux.RUnlock()
+
+	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
+		return channel.ID == id
+	})
+	if idx == -1 {
+		return domain.Chat{}, false
+	}
+
+	return h.chats[idx], true
+}
+
+// allChats returns a copy of the cached chats
+func (h *Handler) allChats() []domain.Chat {
+	h.chatsMux.RLock()
+	defer h.chatsMux.RUnlock()
+
+	return slices.Clone(h.chats)
+}
+
+// messageRecord converts a telegram message to the stored form
+func messageRecord(message *tgbotapi.Message) domain.ChatMessage {
+	record := domain.ChatMessage{
+		ChatID:    message.Chat.ID,
+		MessageID: message.MessageID,
+		Text:      messageText(message),
+		// voice messages have no text of their own, transcribeMessage puts the transcript there
+		Transcribed: isVoice(message) && message.Text != "",
+	}
+	if message.From != nil {
+		record.UserID = message.From.ID
+		record.UserName = authorName(message.From)
+		record.IsBot = message.From.IsBot
+	}
+	if message.ReplyToMessage != nil {
+		record.ReplyToID = message.ReplyToMessage.MessageID
+	}
+
+	return record
+}
+
+// rememberMessage stores the message if the chat uses history or reply threads.
+// Chats that may not use the bot are not stored, the bot does not answer them anyway.
+func (h *Handler) rememberMessage(message *tgbotapi.Message) {
+	if message == nil || messageText(message) == "" || !h.checkAllowed(message.Chat.ID) {
+		return
+	}
+
+	chat, ok := h.getChat(message.Chat.ID)
+	if !ok || (chat.HistoryLength == 0 && chat.ThreadDepth == 0) {
+		return
+	}
+
+	if err := h.db.AddChatMessage(messageRecord(message)); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
+
+// replyChain returns up to depth ancestors of the message in chronological order.
+// Telegram delivers only the direct parent, older ones are restored from stored messages.
+func (h *Handler) replyChain(chat domain.Chat, message *tgbotapi.Message, depth int) []domain.ChatMessage {
+	if message.ReplyToMessage == nil || depth == 0 {
+		return nil
+	}
+
+	parent := messageRecord(message.ReplyToMessage)
+	chain := []domain.ChatMessage{parent}
+
+	stored, err := h.db.GetChatMessage(chat.ID, parent.MessageID)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return chain
+	}
+
+	replyTo := stored.ReplyToID
+	// replies always point to older messages, checking it protects from loops in broken data
+	for len(chain) < depth && replyTo != 0 && replyTo < chain[len(chain)-1].MessageID {
+		ancestor, err2 := h.db.GetChatMessage(chat.ID, replyTo)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			break
+		}
+		if ancestor.ID == 0 {
+			break
+		}
+
+		chain = append(chain, ancestor)
+		replyTo = ancestor.ReplyToID
+	}
+
+	slices.Reverse(chain)
+
+	return chain
+}
+
+// historyWindow returns the latest messages of the chat that fit into its history length
+// and token budget, in chronological order. Messages with ids from exclude are skipped.
+func (h *Handler) historyWindow(chat domain.Chat, exclude ...int) []domain.ChatMessage {
+	if chat.HistoryLength == 0 {
+		return nil
+	}
+
+	messages, err := h.db.GetChatHistory(chat.ID, chat.HistoryLength+len(exclude))
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return nil
+	}
+
+	// history should not take more than a quarter of the model context, the rest is for the question and the answer
+	budget := chat.HistoryTokens
+	if caps, _ := h.ai.Capabilities(h.chatModel(chat.AIModel)); caps.MaxContext > 0 && (budget == 0 || budget > caps.MaxContext/4) {
+		budget = caps.MaxContext / 4
+	}
+
+	var window []domain.ChatMessage
+	tokens := 0
+	for i := len(messages) - 1; i >= 0 && len(window) < chat.HistoryLength; i-- {
+		if slices.Contains(exclude, messages[i].MessageID) {
+			continue
+		}
+
+		tokens += estimateTokens(messages[i].UserName) + estimateTokens(messages[i].Text)
+		if budget > 0 && tokens > budget {
+			break
+		}
+
+		window = append(window, messages[i])
+	}
+
+	slices.Reverse(window)
+
+	return window
+}
+
+// SetMessageRetention sets how long the chat messages are kept, 0 keeps them forever
+func (h *Handler) SetMessageRetention(retention time.Duration) {
+	h.messageRetention = retention
+}
+
+// RunHistoryCleanup deletes the messages older than the retention once a day, until ctx is done
+func (h *Handler) RunHistoryCleanup(ctx context.Context) {
+	if h.messageRetention == 0 {
+		return
+	}
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := h.db.DeleteChatMessages(time.Now().Add(-h.messageRetention)); err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
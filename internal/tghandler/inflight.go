@@ -0,0 +1,32 @@
+package tghandler
+
+import (
+	"context"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Handle handles the update in the background, Wait waits for it on shutdown
+func (h *Handler) Handle(update tgbotapi.Update) {
+	h.inFlight.Add(1)
+	go func() {
+		defer h.inFlight.Done()
+		h.HandleEvents(update)
+	}()
+}
+
+// Wait waits for the updates being handled until ctx is done, false if some of them are still running
+func (h *Handler) Wait(ctx context.Context) bool {
+	drained := make(chan struct{})
+	go func() {
+		h.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
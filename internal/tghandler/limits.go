@@ -0,0 +1,227 @@
+package tghandler
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+	"golang.org/x/exp/slices"
+)
+
+type requestKind string
+
+const (
+	textRequest  requestKind = "text"
+	imageRequest requestKind = "image"
+
+	// the counts of the days before this many are deleted, enough for every timezone
+	dailyCountsKept = 2
+	// a new chat admin waits this long to stop being limited
+	chatAdminsTTL = 10 * time.Minute
+)
+
+// chatAdminCache keeps the admins of the chats, limits are checked on every request to a model
+type chatAdminCache struct {
+	chats map[int64]adminList
+	mux   sync.Mutex
+}
+
+type adminList struct {
+	ids     []int64
+	fetched time.Time
+}
+
+// limitNotices remembers until when a user was told about the limit, so spamming gets one answer
+type limitNotices struct {
+	until map[string]time.Time
+	mux   sync.Mutex
+}
+
+// SetLimits sets the rate limits and daily caps of the requests to the models
+func (h *Handler) SetLimits(limits cfg.Limits) {
+	h.limits = limits
+}
+
+// withinLimits takes the request of the user from the rate limits and the daily caps of the user and the chat.
+// If a limit is hit the user is told when it resets and false is returned. Chat admins and bot admins
+// are not limited and not counted. The counters are shared by the replicas through the database,
+// a broken database does not stop the bot.
+func (h *Handler) withinLimits(update tgbotapi.Update, kind requestKind) bool {
+	chat, ok := h.getChat(update.Message.Chat.ID)
+	if !ok {
+		return false
+	}
+	if h.isAdmin(update.Message.From.ID) || h.isCachedChatAdmin(chat.ID, chat.Type, update.Message.From.ID) {
+		return true
+	}
+	chatKey := strconv.FormatInt(chat.ID, 10)
+	userKey := chatKey + ":" + strconv.FormatInt(update.Message.From.ID, 10)
+
+	wait, daily := h.checkLimits(chatKey, userKey, kind, time.Now().In(chatLocation(chat)))
+	if wait == 0 {
+		return true
+	}
+
+	h.limitNotice(update, userKey, wait, daily, kind)
+	return false
+}
+
+// checkLimits returns how long the user has to wait, 0 if the request is allowed, and whether a daily cap was hit.
+// Every bucket and cap is taken from in turn, when one of them denies the request the ones taken
+// already are given back, so a denied request costs nothing.
+func (h *Handler) checkLimits(chatKey string, userKey string, kind requestKind, now time.Time) (time.Duration, bool) {
+	var undo []func() error
+	giveBack := func() {
+		for _, fn := range undo {
+			if err := fn(); err != nil {
+				sentry.CaptureException(err)
+				log.Println(err)
+			}
+		}
+	}
+
+	buckets := []struct {
+		key  string
+		rate cfg.Rate
+	}{
+		{"user:" + userKey, h.limits.User},
+		{"chat:" + chatKey, h.limits.Chat},
+	}
+	for _, bucket := range buckets {
+		if bucket.rate.Burst == 0 {
+			continue
+		}
+		wait, err := h.db.TakeToken(bucket.key, bucket.rate.Burst, bucket.rate.Period/time.Duration(bucket.rate.Burst))
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			continue
+		}
+		if wait > 0 {
+			giveBack()
+			return wait, false
+		}
+		key, burst := bucket.key, bucket.rate.Burst
+		undo = append(undo, func() error { return h.db.ReturnToken(key, burst) })
+	}
+
+	userCap, chatCap := h.limits.UserDailyText, h.limits.ChatDailyText
+	if kind == imageRequest {
+		userCap, chatCap = h.limits.UserDailyImages, h.limits.ChatDailyImages
+	}
+	caps := []struct {
+		key   string
+		limit int
+	}{
+		{string(kind) + ":user:" + userKey, userCap},
+		{string(kind) + ":chat:" + chatKey, chatCap},
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, c := range caps {
+		if c.limit <= 0 {
+			continue
+		}
+		allowed, err := h.db.CountDaily(c.key, day, c.limit)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			continue
+		}
+		if !allowed {
+			giveBack()
+			return day.AddDate(0, 0, 1).Sub(now), true
+		}
+		key := c.key
+		undo = append(undo, func() error { return h.db.UncountDaily(key, day) })
+	}
+
+	return 0, false
+}
+
+// isCachedChatAdmin checks the user is an admin of the chat, the admins are fetched once in chatAdminsTTL
+func (h *Handler) isCachedChatAdmin(chatID int64, chatType string, userID int64) bool {
+	if chatType == domain.ChatTypePrivate {
+		return true
+	}
+
+	h.chatAdmins.mux.Lock()
+	cached, ok := h.chatAdmins.chats[chatID]
+	h.chatAdmins.mux.Unlock()
+	if !ok || time.Since(cached.fetched) > chatAdminsTTL {
+		admins, err := h.bot.GetChatAdministrators(tgbotapi.ChatAdministratorsConfig{ChatConfig: tgbotapi.ChatConfig{ChatID: chatID}})
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		cached = adminList{fetched: time.Now()}
+		for _, admin := range admins {
+			cached.ids = append(cached.ids, admin.User.ID)
+		}
+		h.chatAdmins.mux.Lock()
+		h.chatAdmins.chats[chatID] = cached
+		h.chatAdmins.mux.Unlock()
+	}
+
+	return slices.Contains(cached.ids, userID)
+}
+
+// limitNotice tells the user when the limit resets, once until it does
+func (h *Handler) limitNotice(update tgbotapi.Update, userKey string, wait time.Duration, daily bool, kind requestKind) {
+	resetAt := time.Now().Add(wait)
+
+	h.limitNotices.mux.Lock()
+	if time.Now().Before(h.limitNotices.until[userKey]) {
+		h.limitNotices.mux.Unlock()
+		return
+	}
+	h.limitNotices.until[userKey] = resetAt
+	h.limitNotices.mux.Unlock()
+
+	what := "answers"
+	if kind == imageRequest {
+		what = "pictures"
+	}
+	var message string
+	if daily {
+		message = "That's enough " + what + " for today, the limit resets in " + waitText(wait)
+	} else {
+		message = "Too many requests, let me rest for " + waitText(wait)
+	}
+	h.sendMessage(update, message)
+}
+
+// waitText formats the wait like 40s, 5m or 3h20m
+func waitText(wait time.Duration) string {
+	switch {
+	case wait < time.Minute:
+		return strconv.Itoa(int(wait.Seconds())+1) + "s"
+	case wait < time.Hour:
+		return strconv.Itoa(int(wait.Minutes())+1) + "m"
+	default:
+		return strconv.Itoa(int(wait.Hours())) + "h" + strconv.Itoa(int(wait.Minutes())%60) + "m"
+	}
+}
+
+// RunLimitCleanup deletes the daily counts of the past days once a day, until ctx is done
+func (h *Handler) RunLimitCleanup(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := h.db.DeleteDailyCounts(time.Now().AddDate(0, 0, -dailyCountsKept)); err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package tghandler
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+	"github.com/shabablinchikow/nafanya-bot/internal/fetcher"
+	"golang.org/x/exp/slices"
+	"mvdan.cc/xurls/v2"
+)
+
+// maxLinks limits how many pages are read for one question
+const maxLinks = 3
+
+// SetFetcher replaces the page fetcher, e.g. with one using other limits
+func (h *Handler) SetFetcher(f *fetcher.Fetcher) {
+	h.fetcher = f
+}
+
+// messageLinks returns the links of the messages worth reading, YouTube links are left to gemini
+func messageLinks(chat domain.Chat, messages ...*tgbotapi.Message) []string {
+	var links []string
+	add := func(link string) {
+		if !strings.Contains(link, "://") {
+			link = "https://" + link
+		}
+		if strings.Contains(link, "youtube.com") || strings.Contains(link, "youtu.be") {
+			return
+		}
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return
+		}
+		if slices.Contains(links, link) || !fetcher.DomainAllowed(link, chat.LinkAllowDomains, chat.LinkDenyDomains) {
+			return
+		}
+		links = append(links, link)
+	}
+
+	for _, message := range messages {
+		if message == nil {
+			continue
+		}
+		for _, link := range xurls.Relaxed().FindAllString(messageText(message), -1) {
+			add(link)
+		}
+		// links hidden under the text
+		for _, entity := range append(message.Entities, message.CaptionEntities...) {
+			if entity.Type == "text_link" && entity.URL != "" {
+				add(entity.URL)
+			}
+		}
+	}
+
+	if len(links) > maxLinks {
+		links = links[:maxLinks]
+	}
+	return links
+}
+
+// linkContext reads the pages linked in the messages and returns their text to be added to the prompt,
+// pages that could not be read are skipped. Reading is a part of the generation, /stop and shutdown cancel it.
+func (h *Handler) linkContext(chat domain.Chat, messages ...*tgbotapi.Message) string {
+	links := messageLinks(chat, messages...)
+	if len(links) == 0 || h.fetcher == nil {
+		return ""
+	}
+
+	ctx, done := h.startGeneration(chat.ID, h.textTimeout)
+	defer done()
+
+	pages := make([]fetcher.Page, len(links))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page, err := h.fetcher.Fetch(ctx, link)
+			if err != nil {
+				log.Println("Fetch error:", err)
+				return
+			}
+			pages[i] = page
+		}()
+	}
+	wg.Wait()
+
+	var out strings.Builder
+	for i, page := range pages {
+		if page.Text == "" {
+			continue
+		}
+		out.WriteString("\n\nТекст страницы " + links[i])
+		if page.Title != "" {
+			out.WriteString(" (" + page.Title + ")")
+		}
+		out.WriteString(":\n" + page.Text)
+	}
+
+	return out.String()
+}
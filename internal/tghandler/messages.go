@@ -9,6 +9,7 @@ import (
 	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
 	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
 	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+	"github.com/shabablinchikow/nafanya-bot/internal/fetcher"
 	"golang.org/x/exp/slices"
 	"log"
 	"mvdan.cc/xurls/v2"
@@ -23,17 +24,44 @@ type Handler struct {
 	ai           *aihandler.Handler
 	db           *domain.Handler
 	chats        []domain.Chat
+	chatsMux     sync.RWMutex
 	config       domain.BotConfig
 	chatCache    map[int64]chatCache
 	chatCacheMux sync.RWMutex
+	fetcher      *fetcher.Fetcher
+	catalog      cfg.Catalog
+	catalogPath  string
+	catalogMux   sync.RWMutex
+	plans        []cfg.Plan
+
+	// ctx is done when the shutdown grace period is over, model calls are made with contexts derived from it
+	ctx            context.Context
+	textTimeout    time.Duration
+	imageTimeout   time.Duration
+	generations    map[int64]map[uint64]context.CancelFunc // running model calls by chat, for /stop
+	generationID   uint64
+	generationsMux sync.Mutex
+	inFlight       sync.WaitGroup // updates being handled
+
+	reminders   cfg.Reminders
+	paywallSent map[int64]time.Time // when the chat was last told it has not paid
+	paywallMux  sync.Mutex
+	trialDays   int
+
+	messageRetention time.Duration
+
+	limits       cfg.Limits
+	limitNotices limitNotices
+	chatAdmins   chatAdminCache
 }
 
 const (
-	openAIErrorMessage = "Something went wrong with OpenAI API"
-	helloMessage       = "Hello, I'm Nafanya Bot!"
+	aiErrorMessage = "Something went wrong with the AI model"
+	helloMessage   = "Hello, I'm Nafanya Bot!"
 )
 
-func NewHandler(bot *tgbotapi.BotAPI, ai *aihandler.Handler, db *domain.Handler) *Handler {
+// NewHandler creates the handler, model calls in flight are cancelled when ctx is done
+func NewHandler(ctx context.Context, bot *tgbotapi.BotAPI, ai *aihandler.Handler, db *domain.Handler) *Handler {
 	channels, err := db.GetAllChannelsConfig()
 	if err != nil {
 		sentry.CaptureException(err)
@@ -55,6 +83,17 @@ func NewHandler(bot *tgbotapi.BotAPI, ai *aihandler.Handler, db *domain.Handler)
 		chats:     channels,
 		config:    config,
 		chatCache: make(map[int64]chatCache),
+		fetcher:   fetcher.NewFetcher(nil),
+
+		ctx:          ctx,
+		textTimeout:  defaultTextTimeout,
+		imageTimeout: defaultImageTimeout,
+		generations:  make(map[int64]map[uint64]context.CancelFunc),
+
+		paywallSent: make(map[int64]time.Time),
+
+		limitNotices: limitNotices{until: make(map[string]time.Time)},
+		chatAdmins:   chatAdminCache{chats: make(map[int64]adminList)},
 	}
 }
 
@@ -63,14 +102,42 @@ func (h *Handler) HandleEvents(update tgbotapi.Update) {
 	defer sentry.Recover()
 	ctx := context.Background()
 	if update.CallbackQuery != nil {
-		h.handleConfigCallback(update)
+		switch {
+		case strings.HasPrefix(update.CallbackQuery.Data, buyPrefix):
+			h.handleBuyCallback(update)
+		case strings.HasPrefix(update.CallbackQuery.Data, approvalPrefix):
+			h.handleApprovalCallback(update)
+		default:
+			h.handleConfigCallback(update)
+		}
+		return
+	}
+	if update.PreCheckoutQuery != nil {
+		h.preCheckout(update)
+		return
+	}
+	if update.Message != nil && update.Message.SuccessfulPayment != nil {
+		h.handlePayment(update)
 		return
 	}
 	if update.Message != nil { // If we got a message
 		sentry.ConfigureScope(func(scope *sentry.Scope) { scope.SetUser(sentry.User{ID: strconv.Itoa(int(update.Message.From.ID))}) })
 		sentry.AddBreadcrumb(&sentry.Breadcrumb{Category: "chat data", Data: map[string]interface{}{"chat id": update.Message.Chat.ID}})
+		if !h.checkChatExists(update.Message.Chat) {
+			// the message that brought the chat is handled like any other once the chat is registered
+			h.registerChat(update)
+		}
 		if h.checkChatExists(update.Message.Chat) {
+			// voice notes are transcribed on arrival, a voice question to Нафаня is recognized by its transcript
+			if isVoice(update.Message) && h.checkAllowed(update.Message.Chat.ID) {
+				h.handleVoice(update)
+			}
+			if !update.Message.IsCommand() {
+				h.rememberMessage(update.Message)
+			}
 			switch {
+			case h.isStopReply(update):
+				h.stopGeneration(update)
 			case update.Message.IsCommand():
 				span := sentry.StartSpan(ctx, "command", sentry.WithTransactionName("Handle tg command"))
 				h.commandHandler(update)
@@ -88,25 +155,6 @@ func (h *Handler) HandleEvents(update tgbotapi.Update) {
 				h.randomInterference(update)
 				span.Finish()
 			}
-		} else {
-			channel := domain.GetDefaultChat()
-
-			channel.ID = update.Message.Chat.ID
-			channel.Type = update.Message.Chat.Type
-			channel.AIModel = string(cfg.DefaultAIModel())
-			if update.Message.Chat.Type == "private" {
-				channel.ChatName = update.Message.Chat.FirstName + " " + update.Message.Chat.LastName
-			} else {
-				channel.ChatName = update.Message.Chat.Title
-			}
-
-			err := h.db.CreateChannelConfig(channel)
-			if err != nil {
-				sentry.CaptureException(err)
-				log.Println(err)
-			}
-
-			h.reloadChannels()
 		}
 	}
 }
@@ -115,6 +163,8 @@ func (h *Handler) commandHandler(update tgbotapi.Update) {
 	switch update.Message.Command() {
 	case "start":
 		h.startMessage(update)
+	case "stop":
+		h.stopGeneration(update)
 	case "listChats":
 		h.listChats(update)
 	case "chat":
@@ -123,6 +173,16 @@ func (h *Handler) commandHandler(update tgbotapi.Update) {
 		h.chatAddDays(update)
 	case "chatMakeVIP":
 		h.chatMakeVIP(update)
+	case "chatAddCredits":
+		h.chatAddCredits(update)
+	case "chatCredits":
+		h.chatCredits(update)
+	case "buy":
+		h.buy(update)
+	case "refund":
+		h.refund(update)
+	case "chatPayments":
+		h.chatPayments(update)
 	case "chatConfig":
 		h.chatConfig(update)
 	case "chatSetAgro":
@@ -131,16 +191,38 @@ func (h *Handler) commandHandler(update tgbotapi.Update) {
 		h.chatSetAgroCooldown(update)
 	case "chatSetPreviewDeletion":
 		h.chatSetPreviewDeletion(update)
+	case "chatSetHistory":
+		h.chatSetHistory(update)
+	case "chatSetHistoryTokens":
+		h.chatSetHistoryTokens(update)
+	case "chatSetThreadDepth":
+		h.chatSetThreadDepth(update)
+	case "chatSetFileThreshold":
+		h.chatSetFileThreshold(update)
+	case "chatSetTools":
+		h.chatSetTools(update)
+	case "chatSetTimezone":
+		h.chatSetTimezone(update)
+	case "chatSetLinkDomains":
+		h.chatSetLinkDomains(update)
 	case "chatUpdateQuestionPrompt":
 		h.chatUpdatePrompt(update, "question")
 	case "chatUpdateRandomPrompt":
 		h.chatUpdatePrompt(update, "random")
 	case "chatUpdateModel":
 		h.chatUpdateModel(update)
+	case "chatSetFallbacks":
+		h.chatSetFallbacks(update)
 	case "chatUpdateImageModel":
 		h.chatUpdateImageModel(update)
 	case "chatConfigure":
 		h.chatConfigure(update)
+	case "usage":
+		h.chatUsage(update)
+	case "usageAll":
+		h.allUsage(update)
+	case "reloadModels":
+		h.reloadModels(update)
 	case "updateMaxTokens":
 		h.updateMaxTokens(update)
 	}
@@ -154,40 +236,75 @@ func (h *Handler) randomInterference(update tgbotapi.Update) {
 	if len(update.Message.Text) > 20 && len(strings.Split(update.Message.Text, " ")) > 3 {
 		if h.checkAllowed(update.Message.Chat.ID) {
 			h.sendAction(update, tgbotapi.ChatTyping)
-			var message string
-			ans, err := h.ai.GetPromptResponse(h.promptCompiler(update.Message.Chat.ID, RandomInterference, update, false))
+			req := h.promptCompiler(update.Message.Chat.ID, RandomInterference, update, false)
+			if h.isStreaming(update.Message.Chat.ID, false) {
+				h.streamAnswer(update, req)
+				return
+			}
+
+			ctx, done := h.startGeneration(update.Message.Chat.ID, h.textTimeout)
+			ans, model, err := h.ai.GetChatResponseFallback(ctx, req, h.chatFallbacks(update.Message.Chat.ID))
+			done()
+			if errors.Is(err, context.Canceled) {
+				return
+			}
 			if err != nil {
 				sentry.CaptureException(err)
 				log.Println(err)
-				message = openAIErrorMessage + "\n```\n" + err.Error() + "\n```"
-			} else {
-				message = ans
+				h.sendMessage(update, aiErrorText(err, aiErrorMessage))
+				return
 			}
 
-			h.sendMessage(update, message)
+			h.deliverAnswer(update, h.annotateModel(update.Message.Chat.ID, ans, model, false), false)
 		}
 	}
 }
 
 func (h *Handler) personalHandler(update tgbotapi.Update) {
 	if h.checkAllowed(update.Message.Chat.ID) {
-		if isDrawAny(update) && len(update.Message.Text) >= 16 && len(strings.Split(update.Message.Text, " ")) >= 2 {
-			h.generateImage(update)
+		text := messageText(update.Message)
+		if isDrawAny(update) && len(text) >= 16 && len(strings.Split(text, " ")) >= 2 {
+			if h.withinLimits(update, imageRequest) {
+				h.generateImage(update)
+			}
 		} else {
+			chat, _ := h.getChat(update.Message.Chat.ID)
+			if hasPhoto(update.Message) && !h.chatVision(chat) {
+				h.sendMessage(update, noVisionMessage)
+				return
+			}
+			if !h.withinLimits(update, textRequest) {
+				return
+			}
+
 			h.sendAction(update, tgbotapi.ChatTyping)
+			// a voice note in reply to the bot, and "Нафаня, о чём тут?" in reply to a voice note
+			h.transcribeMessage(update.Message)
+			h.transcribeMessage(update.Message.ReplyToMessage)
 			serious := isSerious(update)
-			var message string
-			ans, err := h.ai.GetPromptResponse(h.promptCompiler(update.Message.Chat.ID, Question, update, serious))
+			req := h.promptCompiler(update.Message.Chat.ID, Question, update, serious)
+			if h.isStreaming(update.Message.Chat.ID, isSpeak(update)) {
+				h.streamAnswer(update, req)
+				return
+			}
+
+			ctx, done := h.startGeneration(update.Message.Chat.ID, h.textTimeout)
+			ans, model, err := h.ai.GetChatResponseFallback(ctx, req, h.chatFallbacks(update.Message.Chat.ID))
+			done()
+			if errors.Is(err, context.Canceled) {
+				return
+			}
 			if err != nil {
 				sentry.CaptureException(err)
 				log.Println(err)
-				message = openAIErrorMessage + "\n```\n" + err.Error() + "\n```"
-			} else {
-				message = ans
+				h.sendMessage(update, aiErrorText(err, aiErrorMessage))
+				return
 			}
 
-			h.sendMessage(update, message)
+			h.deliverAnswer(update, h.annotateModel(update.Message.Chat.ID, ans, model, isSpeak(update)), isSpeak(update))
 		}
+	} else {
+		h.paywall(update)
 	}
 }
 
@@ -195,7 +312,7 @@ func (h *Handler) listChats(update tgbotapi.Update) {
 	defer sentry.Recover()
 	if h.isAdmin(update.Message.From.ID) {
 		var message string
-		for _, chat := range h.chats {
+		for _, chat := range h.allChats() {
 			var lastRand string
 			h.chatCacheMux.RLock()
 			if val, ok := h.chatCache[chat.ID]; !ok {
@@ -252,13 +369,6 @@ func (h *Handler) chatAddDays(update tgbotapi.Update) {
 				log.Println(err)
 				return
 			}
-			chat, err2 := h.db.GetChannelConfig(id)
-			if err2 != nil {
-				sentry.CaptureException(err2)
-				log.Println(err2)
-				return
-			}
-
 			days, err3 := strconv.Atoi(args[1])
 			if err3 != nil {
 				sentry.CaptureException(err3)
@@ -266,20 +376,12 @@ func (h *Handler) chatAddDays(update tgbotapi.Update) {
 				return
 			}
 
-			if chat.BilledTo.Before(time.Now()) {
-				chat.BilledTo = time.Now().AddDate(0, 0, days)
-			} else {
-				chat.BilledTo = chat.BilledTo.AddDate(0, 0, days)
-			}
-			err4 := h.db.UpdateChannelConfig(chat)
-			if err4 != nil {
+			if _, err4 := h.extendChat(id, days); err4 != nil {
 				sentry.CaptureException(err4)
 				log.Println(err4)
 				return
 			}
 
-			h.reloadChannels()
-
 			h.sendMessage(update, "Done")
 		} else {
 			h.sendMessage(update, "Wrong number of arguments")
@@ -287,6 +389,17 @@ func (h *Handler) chatAddDays(update tgbotapi.Update) {
 	}
 }
 
+// extendChat adds days to the chat subscription, counting from now if it is over, and returns the new end
+func (h *Handler) extendChat(id int64, days int) (time.Time, error) {
+	billedTo, err := h.db.AddChatDays(id, days)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	h.reloadChannels()
+	return billedTo, nil
+}
+
 func (h *Handler) chatMakeVIP(update tgbotapi.Update) {
 	if h.isAdmin(update.Message.From.ID) {
 		id, err := strconv.ParseInt(update.Message.CommandArguments(), 10, 64)
@@ -295,15 +408,13 @@ func (h *Handler) chatMakeVIP(update tgbotapi.Update) {
 			log.Println(err)
 			return
 		}
-		chat, err2 := h.db.GetChannelConfig(id)
-		if err2 != nil {
+		if _, err2 := h.db.GetChannelConfig(id); err2 != nil {
 			sentry.CaptureException(err2)
 			log.Println(err2)
 			return
 		}
 
-		chat.BilledTo = time.Date(2077, 1, 1, 0, 0, 0, 0, time.UTC)
-		err3 := h.db.UpdateChannelConfig(chat)
+		err3 := h.db.SetBilledTo(id, time.Date(2077, 1, 1, 0, 0, 0, 0, time.UTC))
 		if err3 != nil {
 			sentry.CaptureException(err3)
 			log.Println(err3)
@@ -318,14 +429,16 @@ func (h *Handler) chatMakeVIP(update tgbotapi.Update) {
 
 func (h *Handler) chatConfig(update tgbotapi.Update) {
 	if h.isChatAdmin(update) {
-		idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-			return channel.ID == update.Message.Chat.ID
-		})
-		if idx == -1 {
+		chat, ok := h.getChat(update.Message.Chat.ID)
+		if !ok {
 			return
 		}
 
-		chat := h.chats[idx]
+		credits, err := h.db.GetCredits(chat.ID)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+		}
 
 		message := "Chat: " +
 			chat.ChatName +
@@ -345,11 +458,41 @@ func (h *Handler) chatConfig(update tgbotapi.Update) {
 			"\nIf bot is restarted on server - cooldown will be reset, sorry" +
 			"\n\n Links preview deletion: " + strconv.FormatBool(chat.DeletePreviewMessages) +
 			"\n/chatSetPreviewDeletion <true/false> - set links preview deletion" +
+			"\n\nHistory length: " + strconv.Itoa(chat.HistoryLength) + " messages" +
+			"\n/chatSetHistory <messages> - set how many previous messages bot remembers. Maximum is 100" +
+			"\n0 - disable history" +
+			"\n\nHistory budget: " + strconv.Itoa(chat.HistoryTokens) + " tokens" +
+			"\n/chatSetHistoryTokens <tokens> - set approximate token budget for history. Minimum is 100, max is 16000" +
+			"\n\nThread depth: " + strconv.Itoa(chat.ThreadDepth) + " messages" +
+			"\n/chatSetThreadDepth <depth> - set how many replies up the thread bot restores when you reply to it. Minimum is 1, max is 50" +
+			"\n\nAnswer file threshold: " + strconv.Itoa(chat.AnswerFileThreshold) + " symbols" +
+			"\n/chatSetFileThreshold <symbols> - send answers longer than this as a .md file. Minimum is 1000, max is 100000" +
+			"\n0 - always send answers as messages" +
+			"\n\nTools: " + h.enabledToolsText(chat) +
+			"\n/chatSetTools <tools> - set tools the model may use, comma separated, `all` or `none`. Available: " + strings.Join(h.toolNames(), ", ") +
+			"\n\nTimezone: " + chatLocation(chat).String() +
+			"\n/chatSetTimezone <timezone> - set timezone for dates, like Europe/Berlin" +
+			"\n\nLinks allowed from: " + domainsText(chat.LinkAllowDomains, "all domains") +
+			"\nLinks denied from: " + domainsText(chat.LinkDenyDomains, "none") +
+			"\n/chatSetLinkDomains <allow/deny> <domains> - set comma separated domains bot reads links from or never reads, `none` to clear the list" +
+			"\n\nVoice transcripts: " + strconv.FormatBool(chat.AutoTranscribe) +
+			"\n/chatConfigure - toggle posting the transcript of every voice message" +
+			"\n\nVoice replies: " + chat.VoiceReplies +
+			"\n/chatConfigure - answer with text, voice or both. \"Нафаня, скажи голосом ...\" always gets a voice answer" +
+			"\n\nStream answers: " + strconv.FormatBool(chat.StreamAnswers) +
+			"\n/chatConfigure - show answers while they are written, text answers only" +
 			"\n\nAI model: " + chat.AIModel +
-			"\n/chatUpdateModel <model> - set AI model, use `" + string(cfg.AIModelGPT55) + "` or `" + string(cfg.AIModelGemini35) + "` or `" + string(cfg.AIModelDeepSeekV4) + "`" +
+			"\n/chatUpdateModel <model> - set AI model, use " + h.modelsText() +
+			"\n\nFallback models: " + fallbacksText(chat) +
+			"\n/chatSetFallbacks <models> - set comma separated models tried in order when the AI model fails, `none` to disable. /chatConfigure toggles them too" +
+			"\n\nShow answer model: " + strconv.FormatBool(chat.ShowAnswerModel) +
+			"\n/chatConfigure - add the name of the model that answered to text answers" +
 			"\n\nImage model: " + chat.ImageModel +
-			"\n/chatUpdateImageModel <model> - set image model, use `" + string(cfg.ImageModelGPTImage2) + "` or `" + string(cfg.ImageModelGemini31) + "`" +
-			"\n\nBilled to: " + chat.BilledTo.Format("2006-01-02 15:04:05")
+			"\n/chatUpdateImageModel <model> - set image model, use " + h.imageModelsText() +
+			"\n\nBilled to: " + chat.BilledTo.Format("2006-01-02 15:04:05") +
+			"\n/buy - pay for the bot with Telegram Stars" +
+			"\nCredits: " + strconv.FormatInt(credits, 10) + ", they pay for the requests after the billed date" +
+			"\n/usage <days> - tokens the chat used by day and model, 7 days by default"
 
 		h.sendMessage(update, message)
 	}
@@ -474,6 +617,283 @@ func (h *Handler) chatSetPreviewDeletion(update tgbotapi.Update) {
 	}
 }
 
+func (h *Handler) chatSetHistory(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		newLength, err := strconv.Atoi(update.Message.CommandArguments())
+
+		if newLength < 0 || newLength > 100 {
+			err = errors.New("invalid history length format, use number from 0 to 100")
+		}
+
+		if err != nil {
+			h.sendMessage(update, "invalid history length format, use number from 0 to 100")
+			return
+		}
+
+		chat, err2 := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		chat.HistoryLength = newLength
+		err3 := h.db.UpdateChannelConfig(chat)
+		if err3 != nil {
+			sentry.CaptureException(err3)
+			log.Println(err3)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func (h *Handler) chatSetHistoryTokens(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		newTokens, err := strconv.Atoi(update.Message.CommandArguments())
+
+		if newTokens < 100 || newTokens > 16000 {
+			err = errors.New("invalid history budget format, use number from 100 to 16000")
+		}
+
+		if err != nil {
+			h.sendMessage(update, "invalid history budget format, use number from 100 to 16000")
+			return
+		}
+
+		chat, err2 := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		chat.HistoryTokens = newTokens
+		err3 := h.db.UpdateChannelConfig(chat)
+		if err3 != nil {
+			sentry.CaptureException(err3)
+			log.Println(err3)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func (h *Handler) chatSetThreadDepth(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		newDepth, err := strconv.Atoi(update.Message.CommandArguments())
+
+		if newDepth < 1 || newDepth > 50 {
+			err = errors.New("invalid thread depth format, use number from 1 to 50")
+		}
+
+		if err != nil {
+			h.sendMessage(update, "invalid thread depth format, use number from 1 to 50")
+			return
+		}
+
+		chat, err2 := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		chat.ThreadDepth = newDepth
+		err3 := h.db.UpdateChannelConfig(chat)
+		if err3 != nil {
+			sentry.CaptureException(err3)
+			log.Println(err3)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func (h *Handler) chatSetFileThreshold(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		newThreshold, err := strconv.Atoi(update.Message.CommandArguments())
+
+		if newThreshold != 0 && (newThreshold < 1000 || newThreshold > 100000) {
+			err = errors.New("invalid file threshold format, use 0 or number from 1000 to 100000")
+		}
+
+		if err != nil {
+			h.sendMessage(update, "invalid file threshold format, use 0 or number from 1000 to 100000")
+			return
+		}
+
+		chat, err2 := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		chat.AnswerFileThreshold = newThreshold
+		err3 := h.db.UpdateChannelConfig(chat)
+		if err3 != nil {
+			sentry.CaptureException(err3)
+			log.Println(err3)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func (h *Handler) chatSetTools(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		names := h.toolNames()
+		args := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+		var enabled []string
+		switch args {
+		case "all":
+			enabled = names
+		case "none":
+		default:
+			for _, name := range strings.Split(args, ",") {
+				name = strings.TrimSpace(name)
+				if !slices.Contains(names, name) {
+					h.sendMessage(update, "invalid tools format, use `all`, `none` or comma separated list of: "+strings.Join(names, ", "))
+					return
+				}
+				enabled = append(enabled, name)
+			}
+		}
+
+		chat, err := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			return
+		}
+
+		// disabled tools are stored, so the tools added later are enabled everywhere
+		chat.DisabledTools = []string{}
+		for _, name := range names {
+			if !slices.Contains(enabled, name) {
+				chat.DisabledTools = append(chat.DisabledTools, name)
+			}
+		}
+		err2 := h.db.UpdateChannelConfig(chat)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func (h *Handler) chatSetTimezone(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		name := strings.TrimSpace(update.Message.CommandArguments())
+		location, err := time.LoadLocation(name)
+		if err != nil || name == "" {
+			h.sendMessage(update, "invalid timezone format, use IANA name like Europe/Moscow")
+			return
+		}
+
+		chat, err2 := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		chat.Timezone = location.String()
+		err3 := h.db.UpdateChannelConfig(chat)
+		if err3 != nil {
+			sentry.CaptureException(err3)
+			log.Println(err3)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func (h *Handler) chatSetLinkDomains(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		args := strings.Fields(strings.ToLower(update.Message.CommandArguments()))
+		if len(args) != 2 || (args[0] != "allow" && args[0] != "deny") {
+			h.sendMessage(update, "invalid link domains format, use `allow example.com,habr.com`, `deny example.com` or `allow none`")
+			return
+		}
+
+		domains := []string{}
+		if args[1] != "none" {
+			for _, name := range strings.Split(args[1], ",") {
+				name = strings.TrimPrefix(strings.TrimSpace(name), ".")
+				if name == "" || strings.ContainsAny(name, "/:") {
+					h.sendMessage(update, "invalid domain "+name+", use domain names like example.com")
+					return
+				}
+				domains = append(domains, name)
+			}
+		}
+
+		chat, err := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			return
+		}
+
+		if args[0] == "allow" {
+			chat.LinkAllowDomains = domains
+		} else {
+			chat.LinkDenyDomains = domains
+		}
+		err2 := h.db.UpdateChannelConfig(chat)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
+func domainsText(domains []string, empty string) string {
+	if len(domains) == 0 {
+		return empty
+	}
+	return strings.Join(domains, ", ")
+}
+
+func (h *Handler) enabledToolsText(chat domain.Chat) string {
+	var names []string
+	for _, tool := range h.chatTools(chat) {
+		names = append(names, tool.Name())
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
 func (h *Handler) chatUpdatePrompt(update tgbotapi.Update, typeOfPrompt string) {
 	if h.isChatAdmin(update) {
 		chat, err := h.db.GetChannelConfig(update.Message.Chat.ID)
@@ -509,6 +929,11 @@ func (h *Handler) chatUpdatePrompt(update tgbotapi.Update, typeOfPrompt string)
 	}
 }
 
+// modelsText lists the registered text models for the help messages
+func (h *Handler) modelsText() string {
+	return "`" + strings.Join(h.ai.Models(), "` or `") + "`"
+}
+
 func (h *Handler) chatUpdateModel(update tgbotapi.Update) {
 	if h.isChatAdmin(update) {
 		chat, err := h.db.GetChannelConfig(update.Message.Chat.ID)
@@ -519,10 +944,10 @@ func (h *Handler) chatUpdateModel(update tgbotapi.Update) {
 		}
 
 		arg := update.Message.CommandArguments()
-		if cfg.IsValidAIModel(arg) {
+		if h.ai.HasModel(arg) {
 			chat.AIModel = arg
 		} else {
-			h.sendMessage(update, "Invalid model, use `"+string(cfg.AIModelGPT55)+"` or `"+string(cfg.AIModelGemini35)+"` or `"+string(cfg.AIModelDeepSeekV4)+"`")
+			h.sendMessage(update, "Invalid model, use "+h.modelsText())
 			return
 		}
 
@@ -539,6 +964,45 @@ func (h *Handler) chatUpdateModel(update tgbotapi.Update) {
 	}
 }
 
+func (h *Handler) chatSetFallbacks(update tgbotapi.Update) {
+	if h.isChatAdmin(update) {
+		args := strings.TrimSpace(update.Message.CommandArguments())
+
+		models := []string{}
+		if args != "none" {
+			for _, model := range strings.Split(args, ",") {
+				model = strings.TrimSpace(model)
+				if !h.ai.HasModel(model) {
+					h.sendMessage(update, "Invalid model "+model+", use comma separated list of "+h.modelsText()+" or `none`")
+					return
+				}
+				if !slices.Contains(models, model) {
+					models = append(models, model)
+				}
+			}
+		}
+
+		chat, err := h.db.GetChannelConfig(update.Message.Chat.ID)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			return
+		}
+
+		chat.FallbackModels = models
+		err2 := h.db.UpdateChannelConfig(chat)
+		if err2 != nil {
+			sentry.CaptureException(err2)
+			log.Println(err2)
+			return
+		}
+
+		h.reloadChannels()
+
+		h.sendMessage(update, "Done")
+	}
+}
+
 // extractCaption returns the original message text with all URLs stripped and trimmed.
 // Returns empty string if there's nothing left (message was just a URL).
 func extractCaption(text string) string {
@@ -599,34 +1063,56 @@ func buildFixedMessage(username, url, caption string) string {
 }
 
 func (h *Handler) generateImage(update tgbotapi.Update) {
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == update.Message.Chat.ID
-	})
+	chat, _ := h.getChat(update.Message.Chat.ID)
+	imageModel := h.chatImageModel(chat.ImageModel)
 
-	imageModel := string(cfg.DefaultImageModel())
-	if idx >= 0 && h.chats[idx].ImageModel != "" {
-		imageModel = h.chats[idx].ImageModel
+	prompt := getCleanDrawPrompt(messageText(update.Message))
+	h.sendAction(update, tgbotapi.ChatUploadPhoto)
+
+	// replying to a photo, including one the bot drew, redraws it instead of starting from scratch
+	var images []aihandler.Image
+	if hasPhoto(update.Message) {
+		images = h.messageImages(update.Message)
 	}
 
-	prompt := getCleanDrawPrompt(update.Message.Text)
-	h.sendAction(update, tgbotapi.ChatUploadPhoto)
+	ctx, done := h.startGeneration(update.Message.Chat.ID, h.imageTimeout)
+	defer done()
+
+	record := h.recordUsage(update.Message.Chat.ID, update.Message.From.ID)
+	onUsage := func(usage aihandler.Usage) {
+		usage.Model = imageModel.Alias
+		record(usage)
+	}
 
-	switch imageModel {
-	case string(cfg.ImageModelGemini31):
-		data, mimeType, err := h.ai.GetImageFromPromptBanana(prompt)
+	switch imageModel.Provider {
+	case cfg.ProviderGemini:
+		data, mimeType, err := h.ai.EditImageFromPromptBanana(ctx, prompt, imageModel.Backend, images, onUsage)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
 		if err != nil {
 			sentry.CaptureException(err)
 			log.Println(err)
-			h.sendMessage(update, "🍌 Банана не смогла нарисовать...\n```\n"+err.Error()+"\n```")
+			h.sendMessage(update, aiErrorText(err, "🍌 Банана не смогла нарисовать..."))
 			return
 		}
 		h.sendImageByBytes(update, data, mimeType)
 	default:
-		data, mimeType, err := h.ai.GetImageFromPrompt(prompt)
+		var data []byte
+		var mimeType string
+		var err error
+		if len(images) > 0 {
+			data, mimeType, err = h.ai.EditImageFromPrompt(ctx, prompt, imageModel.Backend, images, onUsage)
+		} else {
+			data, mimeType, err = h.ai.GetImageFromPrompt(ctx, prompt, imageModel.Backend, onUsage)
+		}
+		if errors.Is(err, context.Canceled) {
+			return
+		}
 		if err != nil {
 			sentry.CaptureException(err)
 			log.Println(err)
-			h.sendMessage(update, openAIErrorMessage+"\n```\n"+err.Error()+"\n```")
+			h.sendMessage(update, aiErrorText(err, aiErrorMessage))
 			return
 		}
 		h.sendImageByBytes(update, data, mimeType)
@@ -643,10 +1129,10 @@ func (h *Handler) chatUpdateImageModel(update tgbotapi.Update) {
 		}
 
 		arg := update.Message.CommandArguments()
-		if cfg.IsValidImageModel(arg) {
+		if h.getCatalog().IsValidImageModel(arg) {
 			chat.ImageModel = arg
 		} else {
-			h.sendMessage(update, "Invalid image model, use `"+string(cfg.ImageModelGPTImage2)+"` or `"+string(cfg.ImageModelGemini31)+"`")
+			h.sendMessage(update, "Invalid image model, use "+h.imageModelsText())
 			return
 		}
 
@@ -667,16 +1153,15 @@ const (
 	cbPrefix = "cfg:"
 )
 
-func configKeyboard(chat domain.Chat) tgbotapi.InlineKeyboardMarkup {
+func (h *Handler) configKeyboard(chat domain.Chat) tgbotapi.InlineKeyboardMarkup {
+	aiModels := h.ai.Models()
+	imgModels := h.getCatalog().ImageAliases()
 	// Convert typed model slices to string slices
-	aiModels := make([]string, len(cfg.GetAllAIModels()))
-	for i, m := range cfg.GetAllAIModels() {
-		aiModels[i] = string(m)
-	}
-	imgModels := make([]string, len(cfg.GetAllImageModels()))
-	for i, m := range cfg.GetAllImageModels() {
-		imgModels[i] = string(m)
+	speechModels := make([]string, len(cfg.GetAllSpeechModels()))
+	for i, m := range cfg.GetAllSpeechModels() {
+		speechModels[i] = string(m)
 	}
+	voiceModes := []string{domain.VoiceRepliesOff, domain.VoiceRepliesVoice, domain.VoiceRepliesBoth}
 	bools := []string{"true", "false"}
 
 	row := func(label string, opts []string, current string, field string) []tgbotapi.InlineKeyboardButton {
@@ -700,9 +1185,36 @@ func configKeyboard(chat domain.Chat) tgbotapi.InlineKeyboardMarkup {
 	if chat.DeletePreviewMessages {
 		previewStr = "true"
 	}
-	imgModel := chat.ImageModel
-	if imgModel == "" {
-		imgModel = string(cfg.DefaultImageModel())
+	transcribeStr := "false"
+	if chat.AutoTranscribe {
+		transcribeStr = "true"
+	}
+	streamStr := "false"
+	if chat.StreamAnswers {
+		streamStr = "true"
+	}
+	showModelStr := "false"
+	if chat.ShowAnswerModel {
+		showModelStr = "true"
+	}
+
+	// fallbacks are toggled one by one, the order is the order they were switched on
+	var fallbackButtons []tgbotapi.InlineKeyboardButton
+	for _, m := range aiModels {
+		text := m
+		if i := slices.Index(chat.FallbackModels, m); i != -1 {
+			text = strconv.Itoa(i+1) + ". " + m
+		}
+		fallbackButtons = append(fallbackButtons, tgbotapi.NewInlineKeyboardButtonData(text, cbPrefix+"fallback:"+m))
+	}
+	imgModel := h.chatImageModel(chat.ImageModel).Alias
+	speechModel := chat.SpeechModel
+	if speechModel == "" {
+		speechModel = string(cfg.DefaultSpeechModel())
+	}
+	voiceMode := chat.VoiceReplies
+	if voiceMode == "" {
+		voiceMode = domain.VoiceRepliesOff
 	}
 
 	return tgbotapi.NewInlineKeyboardMarkup(
@@ -714,6 +1226,18 @@ func configKeyboard(chat domain.Chat) tgbotapi.InlineKeyboardMarkup {
 		row("Emotions", bools, emotionsStr, "emotions"),
 		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Delete link previews ──", "noop")),
 		row("Delete previews", bools, previewStr, "preview"),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Voice transcripts ──", "noop")),
+		row("Voice transcripts", bools, transcribeStr, "transcribe"),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Voice replies ──", "noop")),
+		row("Voice replies", voiceModes, voiceMode, "voice"),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Speech model ──", "noop")),
+		row("Speech model", speechModels, speechModel, "speechmodel"),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Stream answers ──", "noop")),
+		row("Stream answers", bools, streamStr, "stream"),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Fallback models ──", "noop")),
+		fallbackButtons,
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("── Show answer model ──", "noop")),
+		row("Show answer model", bools, showModelStr, "showmodel"),
 	)
 }
 
@@ -729,7 +1253,7 @@ func (h *Handler) chatConfigure(update tgbotapi.Update) {
 	}
 
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "⚙️ Chat configuration")
-	msg.ReplyMarkup = configKeyboard(chat)
+	msg.ReplyMarkup = h.configKeyboard(chat)
 	if _, err := h.bot.Send(msg); err != nil {
 		sentry.CaptureException(err)
 		log.Println(err)
@@ -748,16 +1272,11 @@ func (h *Handler) handleConfigCallback(update tgbotapi.Update) {
 		return
 	}
 
-	// Check admin rights — use chat from the message the button was attached to
-	chatID := cb.Message.Chat.ID
-	userID := cb.From.ID
-	member, err := h.bot.GetChatMember(tgbotapi.GetChatMemberConfig{
-		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID},
-	})
-	if err != nil || (member.Status != "administrator" && member.Status != "creator" && cb.Message.Chat.Type != "private") {
+	if !h.isCallbackAdmin(cb) {
 		_, _ = h.bot.Request(tgbotapi.NewCallbackWithAlert(cb.ID, "Admins only"))
 		return
 	}
+	chatID := cb.Message.Chat.ID
 
 	parts := strings.SplitN(strings.TrimPrefix(data, cbPrefix), ":", 2)
 	if len(parts) != 2 {
@@ -773,17 +1292,37 @@ func (h *Handler) handleConfigCallback(update tgbotapi.Update) {
 
 	switch field {
 	case "aimodel":
-		if cfg.IsValidAIModel(value) {
+		if h.ai.HasModel(value) {
 			chat.AIModel = value
 		}
 	case "imgmodel":
-		if cfg.IsValidImageModel(value) {
+		if h.getCatalog().IsValidImageModel(value) {
 			chat.ImageModel = value
 		}
 	case "emotions":
 		chat.EmotionsEnable = value == "true"
 	case "preview":
 		chat.DeletePreviewMessages = value == "true"
+	case "transcribe":
+		chat.AutoTranscribe = value == "true"
+	case "voice":
+		if value == domain.VoiceRepliesOff || value == domain.VoiceRepliesVoice || value == domain.VoiceRepliesBoth {
+			chat.VoiceReplies = value
+		}
+	case "speechmodel":
+		if cfg.IsValidSpeechModel(value) {
+			chat.SpeechModel = value
+		}
+	case "stream":
+		chat.StreamAnswers = value == "true"
+	case "fallback":
+		if i := slices.Index(chat.FallbackModels, value); i != -1 {
+			chat.FallbackModels = slices.Delete(chat.FallbackModels, i, i+1)
+		} else if h.ai.HasModel(value) {
+			chat.FallbackModels = append(chat.FallbackModels, value)
+		}
+	case "showmodel":
+		chat.ShowAnswerModel = value == "true"
 	default:
 		return
 	}
@@ -795,7 +1334,7 @@ func (h *Handler) handleConfigCallback(update tgbotapi.Update) {
 	h.reloadChannels()
 
 	// Update the keyboard in place
-	edit := tgbotapi.NewEditMessageReplyMarkup(chatID, cb.Message.MessageID, configKeyboard(chat))
+	edit := tgbotapi.NewEditMessageReplyMarkup(chatID, cb.Message.MessageID, h.configKeyboard(chat))
 	if _, err := h.bot.Request(edit); err != nil {
 		log.Println(err)
 	}
@@ -0,0 +1,82 @@
+package tghandler
+
+import (
+	"log"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+)
+
+// LoadModels reads the model catalog from the file, the built-in one if path is empty,
+// and makes its models available to chats. The path is kept for /reloadModels.
+func (h *Handler) LoadModels(path string) error {
+	catalog, err := cfg.LoadCatalog(path)
+	if err != nil {
+		return err
+	}
+
+	h.ai.ApplyCatalog(catalog)
+
+	h.catalogMux.Lock()
+	h.catalog = catalog
+	h.catalogPath = path
+	h.catalogMux.Unlock()
+
+	log.Printf("Loaded models: %s, images: %s", strings.Join(h.ai.Models(), ", "), strings.Join(catalog.ImageAliases(), ", "))
+
+	return nil
+}
+
+func (h *Handler) getCatalog() cfg.Catalog {
+	h.catalogMux.RLock()
+	defer h.catalogMux.RUnlock()
+
+	return h.catalog
+}
+
+// reloadModels rereads the catalog file, the old catalog stays if the new one is broken
+func (h *Handler) reloadModels(update tgbotapi.Update) {
+	if !h.isAdmin(update.Message.From.ID) {
+		h.sendMessage(update, "You are not an admin")
+		return
+	}
+
+	h.catalogMux.RLock()
+	path := h.catalogPath
+	h.catalogMux.RUnlock()
+
+	if err := h.LoadModels(path); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		h.sendMessage(update, "Model catalog is not reloaded: "+err.Error())
+		return
+	}
+
+	h.sendMessage(update, "Models reloaded\nText: "+strings.Join(h.ai.Models(), ", ")+
+		"\nImage: "+strings.Join(h.getCatalog().ImageAliases(), ", "))
+}
+
+// chatModel returns the text model of the chat, the default one if the chat model was disabled or removed
+func (h *Handler) chatModel(model string) string {
+	if h.ai.HasModel(model) {
+		return model
+	}
+	return h.getCatalog().DefaultText
+}
+
+// chatImageModel returns the image model of the chat, the default one if it is not set, disabled or removed
+func (h *Handler) chatImageModel(alias string) cfg.ImageModel {
+	catalog := h.getCatalog()
+	if model, ok := catalog.ImageModel(alias); ok {
+		return model
+	}
+	model, _ := catalog.ImageModel(catalog.DefaultImage)
+	return model
+}
+
+// imageModelsText lists the image models for the help messages
+func (h *Handler) imageModelsText() string {
+	return "`" + strings.Join(h.getCatalog().ImageAliases(), "` or `") + "`"
+}
@@ -0,0 +1,266 @@
+package tghandler
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+const (
+	starsCurrency = "XTR"
+	buyPrefix     = "buy:"
+	// subscriptionPayload is the invoice payload, sub:<chat id>:<days>
+	subscriptionPayload = "sub:"
+	paymentsLimit       = 20
+)
+
+// SetPlans sets the subscription periods chats can buy with Telegram Stars
+func (h *Handler) SetPlans(plans []cfg.Plan) {
+	h.plans = plans
+}
+
+func (h *Handler) findPlan(days int) (cfg.Plan, bool) {
+	for _, plan := range h.plans {
+		if plan.Days == days {
+			return plan, true
+		}
+	}
+	return cfg.Plan{}, false
+}
+
+// buy shows the plans to chat admins, a button sends the invoice of the plan
+func (h *Handler) buy(update tgbotapi.Update) {
+	if !h.isChatAdmin(update) {
+		return
+	}
+	if len(h.plans) == 0 {
+		h.sendMessage(update, "Payments are not available, ask the bot admin")
+		return
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, plan := range h.plans {
+		text := strconv.Itoa(plan.Days) + " days - " + strconv.Itoa(plan.Stars) + " ⭐"
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(text, buyPrefix+strconv.Itoa(plan.Days)),
+		))
+	}
+
+	message := "Choose the period to pay for"
+	if chat, ok := h.getChat(update.Message.Chat.ID); ok && chat.BilledTo.After(time.Now()) {
+		message += ", it is added to the current subscription till " + chat.BilledTo.Format("2006-01-02")
+	}
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, message)
+	msg.ReplyToMessageID = update.Message.MessageID
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := h.bot.Send(msg); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
+
+// handleBuyCallback sends the invoice of the plan picked in the /buy message
+func (h *Handler) handleBuyCallback(update tgbotapi.Update) {
+	cb := update.CallbackQuery
+	_, _ = h.bot.Request(tgbotapi.NewCallback(cb.ID, ""))
+
+	if !h.isCallbackAdmin(cb) {
+		_, _ = h.bot.Request(tgbotapi.NewCallbackWithAlert(cb.ID, "Admins only"))
+		return
+	}
+	days, err := strconv.Atoi(strings.TrimPrefix(cb.Data, buyPrefix))
+	if err != nil {
+		return
+	}
+	plan, ok := h.findPlan(days)
+	if !ok {
+		_, _ = h.bot.Request(tgbotapi.NewCallbackWithAlert(cb.ID, "This plan is not sold anymore, use /buy again"))
+		return
+	}
+
+	chatID := cb.Message.Chat.ID
+	invoice := tgbotapi.NewInvoice(
+		chatID,
+		"Nafanya Bot for "+strconv.Itoa(plan.Days)+" days",
+		"Subscription of the chat for "+strconv.Itoa(plan.Days)+" days",
+		subscriptionPayload+strconv.FormatInt(chatID, 10)+":"+strconv.Itoa(plan.Days),
+		"", // no provider for Stars
+		"",
+		starsCurrency,
+		[]tgbotapi.LabeledPrice{{Label: strconv.Itoa(plan.Days) + " days", Amount: plan.Stars}},
+	)
+	invoice.SuggestedTipAmounts = []int{} // nil is sent as null
+	if _, err := h.bot.Send(invoice); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
+
+// parsePayload reads the chat and the days of a subscription invoice
+func parsePayload(payload string) (int64, int, bool) {
+	rest, ok := strings.CutPrefix(payload, subscriptionPayload)
+	if !ok {
+		return 0, 0, false
+	}
+	chatPart, daysPart, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, 0, false
+	}
+	chatID, err := strconv.ParseInt(chatPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	days, err := strconv.Atoi(daysPart)
+	if err != nil {
+		return 0, 0, false
+	}
+	return chatID, days, true
+}
+
+// preCheckout confirms the payment if the invoice still matches a plan, Telegram waits 10 seconds for the answer
+func (h *Handler) preCheckout(update tgbotapi.Update) {
+	query := update.PreCheckoutQuery
+	// PreCheckoutConfig leaves out ok=false, the API requires it
+	params := tgbotapi.Params{"pre_checkout_query_id": query.ID, "ok": "true"}
+
+	chatID, days, ok := parsePayload(query.InvoicePayload)
+	plan, planOk := h.findPlan(days)
+	_, chatOk := h.getChat(chatID)
+	switch {
+	case !ok || !chatOk:
+		params["ok"] = "false"
+		params["error_message"] = "This invoice is not valid anymore"
+	case !planOk || query.Currency != starsCurrency || query.TotalAmount != plan.Stars:
+		params["ok"] = "false"
+		params["error_message"] = "The price has changed, use /buy again"
+	}
+
+	if _, err := h.bot.MakeRequest("answerPreCheckoutQuery", params); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
+
+// handlePayment extends the chat subscription by the paid days, a repeated update of the same payment is ignored
+func (h *Handler) handlePayment(update tgbotapi.Update) {
+	payment := update.Message.SuccessfulPayment
+	chatID, days, ok := parsePayload(payment.InvoicePayload)
+	if !ok {
+		err := errors.New("unknown payment payload " + payment.InvoicePayload + ", charge " + payment.TelegramPaymentChargeID)
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+
+	added, err := h.db.AddPayment(domain.Payment{
+		ChatID:   chatID,
+		UserID:   update.Message.From.ID,
+		Days:     days,
+		Amount:   payment.TotalAmount,
+		Currency: payment.Currency,
+		ChargeID: payment.TelegramPaymentChargeID,
+	})
+	if err != nil {
+		// the money is taken, the admins have to extend the chat by hand
+		sentry.CaptureException(err)
+		log.Println("Payment", payment.TelegramPaymentChargeID, "is not applied:", err)
+		h.sendMessage(update, "Payment is received but the subscription is not extended, contact the bot admin")
+		return
+	}
+	if !added {
+		return
+	}
+
+	h.reloadChannels()
+	if chat, ok := h.getChat(chatID); ok {
+		h.sendMessage(update, "Thank you! The bot works here till "+chat.BilledTo.Format("2006-01-02 15:04"))
+	}
+}
+
+// refund returns the Stars of a payment and takes its days back, bot admins only
+func (h *Handler) refund(update tgbotapi.Update) {
+	if !h.isAdmin(update.Message.From.ID) {
+		return
+	}
+
+	chargeID := strings.TrimSpace(update.Message.CommandArguments())
+	if chargeID == "" {
+		h.sendMessage(update, "Use /refund <charge id>, see /chatPayments <chat id>")
+		return
+	}
+	payment, err := h.db.GetPayment(chargeID)
+	if err != nil {
+		log.Println(err)
+		h.sendMessage(update, "Unknown payment")
+		return
+	}
+	if payment.RefundedAt != nil {
+		h.sendMessage(update, "Already refunded at "+payment.RefundedAt.Format("2006-01-02 15:04"))
+		return
+	}
+
+	_, err = h.bot.MakeRequest("refundStarPayment", tgbotapi.Params{
+		"user_id":                    strconv.FormatInt(payment.UserID, 10),
+		"telegram_payment_charge_id": payment.ChargeID,
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		h.sendMessage(update, "Refund failed: "+err.Error())
+		return
+	}
+
+	if err := h.db.RefundPayment(payment.ChargeID, update.Message.From.ID); err != nil {
+		// the Stars are returned already, only the record and the days are left
+		sentry.CaptureException(err)
+		log.Println("Refunded payment", payment.ChargeID, "is not recorded:", err)
+		h.sendMessage(update, "Stars are refunded, but the payment is not marked: "+err.Error())
+		return
+	}
+
+	h.reloadChannels()
+	h.sendMessage(update, "Refunded "+strconv.Itoa(payment.Amount)+" ⭐, "+strconv.Itoa(payment.Days)+" days are taken back")
+}
+
+// chatPayments lists the latest payments of the chat, bot admins only
+func (h *Handler) chatPayments(update tgbotapi.Update) {
+	if !h.isAdmin(update.Message.From.ID) {
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(update.Message.CommandArguments()), 10, 64)
+	if err != nil {
+		h.sendMessage(update, "Invalid chat id, use /chatPayments <chat id>")
+		return
+	}
+	payments, err := h.db.GetChatPayments(id, paymentsLimit)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+	if len(payments) == 0 {
+		h.sendMessage(update, "No payments")
+		return
+	}
+
+	message := "Payments:"
+	for _, payment := range payments {
+		message += "\n\n" + payment.CreatedAt.Format("2006-01-02 15:04") +
+			" " + strconv.Itoa(payment.Amount) + " " + payment.Currency +
+			", " + strconv.Itoa(payment.Days) + " days, user " + strconv.FormatInt(payment.UserID, 10) +
+			"\n" + payment.ChargeID
+		if payment.RefundedAt != nil {
+			message += "\nrefunded " + payment.RefundedAt.Format("2006-01-02 15:04")
+		}
+	}
+
+	h.sendMessage(update, message)
+}
@@ -0,0 +1,175 @@
+package tghandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+// botAPICall is a request the bot made to the fake Bot API
+type botAPICall struct {
+	method string
+	params url.Values
+}
+
+// fakeBotAPI answers every Bot API method with success and records the calls, the way BOT_API_ENDPOINT
+// points the bot to a local Bot API server
+type fakeBotAPI struct {
+	calls []botAPICall
+	mux   sync.Mutex
+}
+
+func newFakeBot(t *testing.T) (*tgbotapi.BotAPI, *fakeBotAPI) {
+	t.Helper()
+	fake := &fakeBotAPI{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		_ = r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case method == "getMe":
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"Nafanya","username":"nafanya_bot"}}`))
+			return
+		case strings.HasPrefix(method, "send"):
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+
+		fake.mux.Lock()
+		fake.calls = append(fake.calls, botAPICall{method: method, params: r.PostForm})
+		fake.mux.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", server.URL+"/bot%s/%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, fake
+}
+
+// call returns the only call of the method
+func (f *fakeBotAPI) call(t *testing.T, method string) url.Values {
+	t.Helper()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	var found []url.Values
+	for _, call := range f.calls {
+		if call.method == method {
+			found = append(found, call.params)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("%s called %d times, want once", method, len(found))
+	}
+	return found[0]
+}
+
+func TestParsePayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		chatID  int64
+		days    int
+		ok      bool
+	}{
+		{"sub:-1001234567890:30", -1001234567890, 30, true},
+		{"sub:42:7", 42, 7, true},
+		{"sub:42", 0, 0, false},
+		{"sub:chat:30", 0, 0, false},
+		{"sub:42:month", 0, 0, false},
+		{"42:30", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		chatID, days, ok := parsePayload(tt.payload)
+		if chatID != tt.chatID || days != tt.days || ok != tt.ok {
+			t.Errorf("parsePayload(%q) = %d, %d, %v, want %d, %d, %v", tt.payload, chatID, days, ok, tt.chatID, tt.days, tt.ok)
+		}
+	}
+}
+
+func TestPreCheckout(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		currency string
+		amount   int
+		ok       string
+	}{
+		{"matching plan", "sub:42:30", starsCurrency, 100, "true"},
+		{"unknown chat", "sub:43:30", starsCurrency, 100, "false"},
+		{"broken payload", "sub:42", starsCurrency, 100, "false"},
+		{"plan not sold", "sub:42:7", starsCurrency, 100, "false"},
+		{"changed price", "sub:42:30", starsCurrency, 50, "false"},
+		{"other currency", "sub:42:30", "USD", 100, "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bot, fake := newFakeBot(t)
+			h := &Handler{
+				bot:   bot,
+				chats: []domain.Chat{{ID: 42}},
+				plans: []cfg.Plan{{Days: 30, Stars: 100}},
+			}
+
+			h.preCheckout(tgbotapi.Update{PreCheckoutQuery: &tgbotapi.PreCheckoutQuery{
+				ID:             "query",
+				Currency:       tt.currency,
+				TotalAmount:    tt.amount,
+				InvoicePayload: tt.payload,
+			}})
+
+			params := fake.call(t, "answerPreCheckoutQuery")
+			if params.Get("pre_checkout_query_id") != "query" {
+				t.Errorf("pre_checkout_query_id = %q, want %q", params.Get("pre_checkout_query_id"), "query")
+			}
+			if params.Get("ok") != tt.ok {
+				t.Errorf("ok = %q, want %q", params.Get("ok"), tt.ok)
+			}
+			if tt.ok == "false" && params.Get("error_message") == "" {
+				t.Error("declined without error_message")
+			}
+		})
+	}
+}
+
+func TestBuyCallbackSendsInvoice(t *testing.T) {
+	bot, fake := newFakeBot(t)
+	h := &Handler{
+		bot:   bot,
+		chats: []domain.Chat{{ID: 42, Type: domain.ChatTypePrivate}},
+		plans: []cfg.Plan{{Days: 30, Stars: 100}},
+	}
+
+	h.handleBuyCallback(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:      "callback",
+		From:    &tgbotapi.User{ID: 7},
+		Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 42, Type: domain.ChatTypePrivate}},
+		Data:    buyPrefix + "30",
+	}})
+
+	params := fake.call(t, "sendInvoice")
+	if params.Get("payload") != "sub:42:30" {
+		t.Errorf("payload = %q, want %q", params.Get("payload"), "sub:42:30")
+	}
+	if params.Get("currency") != starsCurrency {
+		t.Errorf("currency = %q, want %q", params.Get("currency"), starsCurrency)
+	}
+	if !strings.Contains(params.Get("prices"), `"amount":100`) {
+		t.Errorf("prices = %s, want the plan price", params.Get("prices"))
+	}
+	chatID, days, ok := parsePayload(params.Get("payload"))
+	if !ok || chatID != 42 || days != 30 {
+		t.Errorf("invoice payload is not read back: %d, %d, %v", chatID, days, ok)
+	}
+}
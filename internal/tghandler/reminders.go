@@ -0,0 +1,159 @@
+package tghandler
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+const (
+	reminderInterval = 15 * time.Minute
+	// expiredNoticeWindow limits the end notice to recently ended subscriptions, chats that ended
+	// long ago before the reminders appeared are not disturbed
+	expiredNoticeWindow = 3 * 24 * time.Hour
+)
+
+// SetReminders sets the reminder offsets and texts
+func (h *Handler) SetReminders(reminders cfg.Reminders) {
+	h.reminders = reminders
+}
+
+// RunReminders checks the subscriptions periodically and reminds the chats about their end, until ctx is done.
+// Every reminder is recorded before it is sent, so a restart does not send it again.
+func (h *Handler) RunReminders(ctx context.Context) {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+
+	for {
+		h.sendReminders()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handler) sendReminders() {
+	defer sentry.Recover()
+
+	chats, err := h.db.GetAllChannelsConfig()
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	for _, chat := range chats {
+		days, ok := h.dueReminder(chat, now)
+		if !ok {
+			continue
+		}
+		fresh, err := h.db.MarkReminder(chat.ID, chat.BilledTo, days)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			continue
+		}
+		if !fresh {
+			continue
+		}
+
+		text := h.reminders.BeforeText
+		if days == 0 {
+			text = h.reminders.ExpiredText
+		}
+		h.notifyChat(chat, reminderText(text, chat, now))
+	}
+}
+
+// dueReminder returns the offset in days of the reminder the chat should have got by now, 0 for the end notice.
+// When several offsets have passed only the closest one is due, a chat is not flooded after a downtime.
+func (h *Handler) dueReminder(chat domain.Chat, now time.Time) (int, bool) {
+	// new chats start with a subscription that ends at once, nobody paid for it
+	period := chat.BilledTo.Sub(chat.CreatedAt)
+	if period < time.Minute {
+		return 0, false
+	}
+
+	left := chat.BilledTo.Sub(now)
+	if left <= 0 {
+		return 0, -left < expiredNoticeWindow
+	}
+
+	// offsets not shorter than the whole subscription, e.g. 3 days before the end of a 3 day trial,
+	// would be due the moment the chat is added
+	periodDays := int(period.Hours()/24 + 0.5)
+	due := 0
+	for _, days := range h.reminders.Days {
+		if days >= periodDays {
+			continue
+		}
+		if left <= time.Duration(days)*24*time.Hour && (due == 0 || days < due) {
+			due = days
+		}
+	}
+	return due, due > 0
+}
+
+// notifyChat sends the text to the chat and to its admins in private, admins who never started the bot are skipped
+func (h *Handler) notifyChat(chat domain.Chat, text string) {
+	if _, err := h.bot.Send(tgbotapi.NewMessage(chat.ID, text)); err != nil {
+		log.Println("Reminder to chat", chat.ID, "is not sent:", err)
+	}
+	if chat.Type == domain.ChatTypePrivate {
+		return
+	}
+
+	admins, err := h.bot.GetChatAdministrators(tgbotapi.ChatAdministratorsConfig{ChatConfig: tgbotapi.ChatConfig{ChatID: chat.ID}})
+	if err != nil {
+		log.Println("Admins of chat", chat.ID, "are not known:", err)
+		return
+	}
+	for _, admin := range admins {
+		if admin.User == nil || admin.User.IsBot {
+			continue
+		}
+		if _, err := h.bot.Send(tgbotapi.NewMessage(admin.User.ID, text)); err != nil {
+			log.Println("Reminder to admin", admin.User.ID, "is not sent:", err)
+		}
+	}
+}
+
+// paywall tells the chat the subscription is over, at most once in the paywall cooldown
+func (h *Handler) paywall(update tgbotapi.Update) {
+	chat, ok := h.getChat(update.Message.Chat.ID)
+	if !ok || h.reminders.PaywallText == "" {
+		return
+	}
+
+	h.paywallMux.Lock()
+	if time.Since(h.paywallSent[chat.ID]) < h.reminders.PaywallCooldown {
+		h.paywallMux.Unlock()
+		return
+	}
+	h.paywallSent[chat.ID] = time.Now()
+	h.paywallMux.Unlock()
+
+	h.sendMessage(update, reminderText(h.reminders.PaywallText, chat, time.Now()))
+}
+
+func reminderText(text string, chat domain.Chat, now time.Time) string {
+	days := int(chat.BilledTo.Sub(now).Hours()/24 + 0.5)
+	if days < 0 {
+		days = 0
+	}
+	return strings.NewReplacer(
+		"{chat}", chat.ChatName,
+		"{date}", chat.BilledTo.Format("2006-01-02 15:04"),
+		"{days}", strconv.Itoa(days),
+	).Replace(text)
+}
@@ -0,0 +1,222 @@
+package tghandler
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Models answer in Markdown, telegram understands only its own flavours of it.
+// Answers are converted to telegram HTML, it is the easiest one to escape correctly.
+// Underscores are left as they are, __init__ and snake__case are far more common than __bold__.
+
+const (
+	// chunkLength leaves room for the tags and entities added by rendering
+	chunkLength = 3500
+
+	codeFence = "```"
+)
+
+var (
+	mdLink       = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^\s)]+)\)`)
+	mdBold       = regexp.MustCompile(`\*\*([^*\n](?:[^\n]*?[^*\n])??)\*\*`)
+	mdStrike     = regexp.MustCompile(`~~([^~\n]+?)~~`)
+	mdItalic     = regexp.MustCompile(`(^|[^*\w])\*([^*\s](?:[^*\n]*[^*\s])?)\*`)
+	mdHeading    = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	mdBullet     = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	mdInlineCode = regexp.MustCompile("`([^`\n]+)`")
+)
+
+// renderMarkdown converts model markdown to telegram HTML
+func renderMarkdown(text string) string {
+	var out strings.Builder
+	var quote []string
+
+	flushQuote := func() {
+		if len(quote) > 0 {
+			out.WriteString("<blockquote>" + strings.Join(quote, "\n") + "</blockquote>\n")
+			quote = nil
+		}
+	}
+
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, codeFence) {
+			flushQuote()
+			lang := strings.TrimSpace(strings.TrimPrefix(trimmed, codeFence))
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), codeFence); i++ {
+				code = append(code, lines[i])
+			}
+			if lang != "" {
+				out.WriteString(`<pre><code class="language-` + html.EscapeString(lang) + `">`)
+			} else {
+				out.WriteString("<pre><code>")
+			}
+			out.WriteString(html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			quote = append(quote, renderInline(strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))))
+			continue
+		}
+		flushQuote()
+
+		switch {
+		case mdHeading.MatchString(trimmed):
+			line = "<b>" + renderInline(mdHeading.FindStringSubmatch(trimmed)[1]) + "</b>"
+		case mdBullet.MatchString(line):
+			match := mdBullet.FindStringSubmatch(line)
+			line = match[1] + "• " + renderInline(match[2])
+		default:
+			line = renderInline(line)
+		}
+		out.WriteString(line + "\n")
+	}
+	flushQuote()
+
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// renderInline converts inline markdown of a single line, code spans are left untouched inside
+func renderInline(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range mdInlineCode.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(renderSpans(text[last:loc[0]]))
+		out.WriteString("<code>" + html.EscapeString(text[loc[2]:loc[3]]) + "</code>")
+		last = loc[1]
+	}
+	out.WriteString(renderSpans(text[last:]))
+
+	return out.String()
+}
+
+func renderSpans(text string) string {
+	text = html.EscapeString(text)
+	text = mdLink.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = mdBold.ReplaceAllString(text, "<b>$1</b>")
+	text = mdStrike.ReplaceAllString(text, "<s>$1</s>")
+	text = mdItalic.ReplaceAllString(text, "$1<i>$2</i>")
+
+	return text
+}
+
+// splitMessage splits the markdown text into chunks no longer than limit runes.
+// It cuts on paragraphs first, then on lines, and words are cut only if a line is longer
+// than the limit. Code blocks cut in the middle get their fences closed and reopened.
+func splitMessage(text string, limit int) []string {
+	if len([]rune(text)) <= limit {
+		return []string{text}
+	}
+
+	var pieces []string
+	for _, block := range markdownBlocks(text) {
+		pieces = append(pieces, splitBlock(block, limit)...)
+	}
+
+	var chunks []string
+	var current string
+	for _, piece := range pieces {
+		switch {
+		case current == "":
+			current = piece
+		case len([]rune(current))+2+len([]rune(piece)) <= limit:
+			current += "\n\n" + piece
+		default:
+			chunks = append(chunks, current)
+			current = piece
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+// markdownBlocks splits the text into paragraphs and whole code blocks
+func markdownBlocks(text string) []string {
+	var blocks []string
+	var current []string
+	inCode := false
+
+	flush := func() {
+		if len(current) > 0 {
+			blocks = append(blocks, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, codeFence) && !inCode:
+			flush()
+			inCode = true
+			current = append(current, line)
+		case strings.HasPrefix(trimmed, codeFence) && inCode:
+			current = append(current, line)
+			inCode = false
+			flush()
+		case trimmed == "" && !inCode:
+			flush()
+		default:
+			current = append(current, line)
+		}
+	}
+	flush()
+
+	return blocks
+}
+
+// splitBlock cuts a single block that does not fit into the limit
+func splitBlock(block string, limit int) []string {
+	if len([]rune(block)) <= limit {
+		return []string{block}
+	}
+
+	lines := strings.Split(block, "\n")
+	open, closing := "", ""
+	if strings.HasPrefix(strings.TrimSpace(lines[0]), codeFence) {
+		open = lines[0] + "\n"
+		closing = "\n" + codeFence
+		lines = lines[1:]
+		if len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), codeFence) {
+			lines = lines[:len(lines)-1]
+		}
+	}
+	room := limit - len([]rune(open)) - len([]rune(closing))
+
+	var pieces []string
+	var current []string
+	size := 0
+	flush := func() {
+		if len(current) > 0 {
+			pieces = append(pieces, open+strings.Join(current, "\n")+closing)
+			current = nil
+			size = 0
+		}
+	}
+
+	for _, line := range lines {
+		runes := []rune(line)
+		for len(runes) > room {
+			flush()
+			pieces = append(pieces, open+string(runes[:room])+closing)
+			runes = runes[room:]
+		}
+		if size+len(runes)+1 > room {
+			flush()
+		}
+		current = append(current, string(runes))
+		size += len(runes) + 1
+	}
+	flush()
+
+	return pieces
+}
@@ -0,0 +1,137 @@
+package tghandler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "hello", "hello"},
+		{"html is escaped", "a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"bold", "**bold** text", "<b>bold</b> text"},
+		{"italic", "an *italic* word", "an <i>italic</i> word"},
+		{"strike", "~~old~~ new", "<s>old</s> new"},
+		{"nested", "**bold with *italic* inside**", "<b>bold with <i>italic</i> inside</b>"},
+		{"nested italic", "*italic with **bold** inside*", "<i>italic with <b>bold</b> inside</i>"},
+		{"bold italic", "***both***", "<i><b>both</b></i>"},
+		{"two bolds", "**a** and **b**", "<b>a</b> and <b>b</b>"},
+		{"link", "[site](https://example.com/?a=1&b=2)", `<a href="https://example.com/?a=1&amp;b=2">site</a>`},
+		{"inline code", "run `a <b> **c**` now", "run <code>a &lt;b&gt; **c**</code> now"},
+		{"dunder", "call __init__ from snake__case__name", "call __init__ from snake__case__name"},
+		{"underscores", "__not bold__", "__not bold__"},
+		{"multiplication", "2 * 3 * 4", "2 * 3 * 4"},
+		{"heading", "## Title *x*", "<b>Title <i>x</i></b>"},
+		{"bullets", "- one\n  * two", "• one\n  • two"},
+		{"quote", "> first\n> **second**\nafter", "<blockquote>first\n<b>second</b></blockquote>\nafter"},
+		{"code block", "```go\nif a < b && **c** {\n}\n```", "<pre><code class=\"language-go\">if a &lt; b &amp;&amp; **c** {\n}</code></pre>"},
+		{"unclosed code block", "```\nx := `y`", "<pre><code>x := `y`</code></pre>"},
+		{"code block language escaped", "```<script>\nx\n```", "<pre><code class=\"language-&lt;script&gt;\">x</code></pre>"},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.text); got != tt.want {
+			t.Errorf("%s: renderMarkdown(%q) = %q, want %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func runes(s string) int {
+	return len([]rune(s))
+}
+
+func TestSplitMessageBoundary(t *testing.T) {
+	fits := strings.Repeat("я", chunkLength)
+	if chunks := splitMessage(fits, chunkLength); len(chunks) != 1 || chunks[0] != fits {
+		t.Errorf("text of exactly %d runes split into %d chunks, want it as is", chunkLength, len(chunks))
+	}
+
+	long := fits + "я"
+	chunks := splitMessage(long, chunkLength)
+	if len(chunks) != 2 || runes(chunks[0]) != chunkLength || chunks[1] != "я" {
+		t.Errorf("text of %d runes split into %d chunks, want %d runes and the rest", runes(long), len(chunks), chunkLength)
+	}
+}
+
+func TestSplitMessageParagraphs(t *testing.T) {
+	first := strings.Repeat("a", chunkLength-10)
+	second := strings.Repeat("b", 20)
+	chunks := splitMessage(first+"\n\n"+second, chunkLength)
+	if len(chunks) != 2 || chunks[0] != first || chunks[1] != second {
+		t.Errorf("chunks = %d of %v runes, want the paragraphs apart", len(chunks), chunkSizes(chunks))
+	}
+
+	// paragraphs that fit together are joined back
+	small := strings.Repeat("c", 100)
+	chunks = splitMessage(first+"\n\n"+small+"\n\n"+small+"\n\n"+second, chunkLength)
+	if len(chunks) != 2 || chunks[1] != small+"\n\n"+small+"\n\n"+second {
+		t.Errorf("chunks = %d of %v runes, want the short paragraphs together", len(chunks), chunkSizes(chunks))
+	}
+}
+
+func TestSplitMessageLines(t *testing.T) {
+	line := strings.Repeat("x", 1000)
+	text := strings.TrimSuffix(strings.Repeat(line+"\n", 5), "\n")
+
+	chunks := splitMessage(text, chunkLength)
+	if len(chunks) != 2 {
+		t.Fatalf("chunks = %d of %v runes, want 2", len(chunks), chunkSizes(chunks))
+	}
+	for _, chunk := range chunks {
+		if runes(chunk) > chunkLength {
+			t.Errorf("chunk of %d runes, want at most %d", runes(chunk), chunkLength)
+		}
+		for _, l := range strings.Split(chunk, "\n") {
+			if l != line {
+				t.Errorf("line of %d runes is cut, want whole lines", runes(l))
+			}
+		}
+	}
+}
+
+func TestSplitMessageCodeBlock(t *testing.T) {
+	line := strings.Repeat("x", 99)
+	text := "intro\n\n```go\n" + strings.TrimSuffix(strings.Repeat(line+"\n", 50), "\n") + "\n```"
+
+	chunks := splitMessage(text, chunkLength)
+	if len(chunks) < 2 {
+		t.Fatalf("chunks = %d, want the code block cut", len(chunks))
+	}
+	code := 0
+	for i, chunk := range chunks {
+		if runes(chunk) > chunkLength {
+			t.Errorf("chunk %d of %d runes, want at most %d", i, runes(chunk), chunkLength)
+		}
+		if strings.Count(chunk, codeFence)%2 != 0 {
+			t.Errorf("chunk %d has unbalanced fences: %q...", i, chunk[:20])
+		}
+		if strings.Contains(chunk, "```go\n") {
+			code += strings.Count(chunk, line)
+		}
+		if rendered := renderMarkdown(chunk); strings.Count(rendered, "<pre>") != strings.Count(rendered, "</pre>") {
+			t.Errorf("chunk %d renders unbalanced code blocks", i)
+		}
+	}
+	if code != 50 {
+		t.Errorf("%d code lines are inside code blocks, want 50", code)
+	}
+}
+
+func TestSplitMessageLongLine(t *testing.T) {
+	text := strings.Repeat("z", chunkLength*2+5)
+	chunks := splitMessage(text, chunkLength)
+	if len(chunks) != 3 || strings.Join(chunks, "") != text {
+		t.Errorf("chunks = %v runes, want the line cut into 3 pieces without losing text", chunkSizes(chunks))
+	}
+}
+
+func chunkSizes(chunks []string) []int {
+	var sizes []int
+	for _, chunk := range chunks {
+		sizes = append(sizes, runes(chunk))
+	}
+	return sizes
+}
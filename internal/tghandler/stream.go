@@ -0,0 +1,146 @@
+package tghandler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+const (
+	streamPlaceholder = "…"
+	streamCursor      = " ▌"
+
+	// telegram starts answering 429 to edits at about one per second in a chat
+	streamEditInterval = 1500 * time.Millisecond
+
+	maxMessageLength = 4096
+)
+
+// isStreaming reports whether the answer should be streamed with message edits.
+// Voice answers need the whole text, so they are never streamed, as are answers of models without streaming.
+func (h *Handler) isStreaming(chatID int64, voiceAsked bool) bool {
+	chat, ok := h.getChat(chatID)
+	if !ok || !chat.StreamAnswers || voiceAsked {
+		return false
+	}
+	if caps, _ := h.ai.Capabilities(h.chatModel(chat.AIModel)); !caps.Streaming {
+		return false
+	}
+
+	return chat.VoiceReplies == "" || chat.VoiceReplies == domain.VoiceRepliesOff
+}
+
+// streamAnswer posts a placeholder and edits it while the model generates the answer
+func (h *Handler) streamAnswer(update tgbotapi.Update, req aihandler.Request) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, streamPlaceholder)
+	msg.ReplyToMessageID = update.Message.MessageID
+
+	placeholder, err := h.bot.Send(msg)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+
+	ctx, done := h.startGeneration(update.Message.Chat.ID, h.textTimeout)
+	defer done()
+
+	var shown, written string
+	lastEdit := time.Now()
+	answer, model, err := h.ai.GetChatResponseStreamFallback(ctx, req, h.chatFallbacks(update.Message.Chat.ID), func(text string) {
+		written = text
+		if time.Since(lastEdit) < streamEditInterval {
+			return
+		}
+		h.editMessage(placeholder, text+streamCursor)
+		shown = text
+		lastEdit = time.Now()
+	})
+	if errors.Is(err, context.Canceled) {
+		// the part written before /stop stays
+		if written == "" {
+			h.deleteBotMessage(placeholder)
+			return
+		}
+		h.finishStream(update, placeholder, written)
+		return
+	}
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		h.editMessage(placeholder, strings.TrimSpace(shown+"\n\n"+aiErrorText(err, aiErrorMessage)))
+		return
+	}
+
+	h.finishStream(update, placeholder, h.annotateModel(update.Message.Chat.ID, answer, model, false))
+}
+
+// finishStream puts the final formatted answer into the placeholder,
+// the parts that do not fit into one message are sent as new messages
+func (h *Handler) finishStream(update tgbotapi.Update, placeholder tgbotapi.Message, answer string) {
+	chat, _ := h.getChat(update.Message.Chat.ID)
+	if chat.AnswerFileThreshold > 0 && len([]rune(answer)) > chat.AnswerFileThreshold {
+		h.deleteBotMessage(placeholder)
+		h.sendAnswer(update, answer)
+		return
+	}
+
+	chunks := splitMessage(answer, chunkLength)
+
+	h.editFormatted(placeholder, chunks[0])
+	placeholder.Text = chunks[0]
+	h.rememberMessage(&placeholder)
+
+	for _, chunk := range chunks[1:] {
+		sent, err := h.sendFormatted(update, chunk)
+		if err != nil {
+			return
+		}
+
+		sent.Text = chunk
+		h.rememberMessage(&sent)
+	}
+}
+
+// editFormatted replaces the message text with rendered markdown, plain text is used if telegram rejects the markup
+func (h *Handler) editFormatted(message tgbotapi.Message, text string) {
+	edit := tgbotapi.NewEditMessageText(message.Chat.ID, message.MessageID, renderMarkdown(text))
+	edit.ParseMode = tgbotapi.ModeHTML
+
+	_, err := h.bot.Send(edit)
+	if isEntitiesError(err) {
+		h.editMessage(message, text)
+		return
+	}
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
+
+func (h *Handler) deleteBotMessage(message tgbotapi.Message) {
+	if _, err := h.bot.Request(tgbotapi.NewDeleteMessage(message.Chat.ID, message.MessageID)); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
+
+// editMessage replaces the text of the message sent by the bot
+func (h *Handler) editMessage(message tgbotapi.Message, text string) {
+	if runes := []rune(text); len(runes) > maxMessageLength {
+		text = string(runes[:maxMessageLength])
+	}
+
+	edit := tgbotapi.NewEditMessageText(message.Chat.ID, message.MessageID, text)
+	if _, err := h.bot.Send(edit); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,148 @@
+package tghandler
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	historyToolLimit   = 20
+	toolResultLogLimit = 4000
+)
+
+// historyTool lets the model look up older messages of the chat that did not fit into the history window
+type historyTool struct {
+	db       *domain.Handler
+	chatID   int64
+	location *time.Location
+}
+
+func (t *historyTool) Name() string {
+	return "chat_history"
+}
+
+func (t *historyTool) Description() string {
+	return "Searches older messages of this chat containing the query, newest first. " +
+		"Use it when asked about something said in the chat before."
+}
+
+func (t *historyTool) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": "word or phrase to look for, case insensitive",
+			},
+			"limit": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("how many messages to return, at most %d", historyToolLimit),
+			},
+		},
+		"required": []string{"query"},
+	}
+}
+
+func (t *historyTool) Call(args map[string]any) (string, error) {
+	query, _ := args["query"].(string)
+	if strings.TrimSpace(query) == "" {
+		return "", fmt.Errorf("query is required")
+	}
+
+	limit := historyToolLimit
+	if value, ok := args["limit"].(float64); ok && value > 0 && int(value) < limit {
+		limit = int(value)
+	}
+
+	messages, err := t.db.SearchChatMessages(t.chatID, strings.TrimSpace(query), limit)
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "nothing found", nil
+	}
+
+	lines := make([]string, 0, len(messages))
+	for _, message := range messages {
+		lines = append(lines, "["+message.CreatedAt.In(t.location).Format("2006-01-02 15:04")+"] "+message.UserName+": "+message.Text)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// chatLocation returns the timezone of the chat, the default one if it is not set or invalid
+func chatLocation(chat domain.Chat) *time.Location {
+	name := chat.Timezone
+	if name == "" {
+		name = domain.DefaultTimezone
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Println(err)
+		return time.UTC
+	}
+	return location
+}
+
+// allTools returns every tool the bot has for the chat, enabled or not
+func (h *Handler) allTools(chat domain.Chat) []aihandler.Tool {
+	location := chatLocation(chat)
+
+	return []aihandler.Tool{
+		aihandler.NewTimeTool(location),
+		aihandler.NewCalculatorTool(),
+		aihandler.NewUnitsTool(),
+		&historyTool{db: h.db, chatID: chat.ID, location: location},
+	}
+}
+
+// chatTools returns the tools enabled in the chat
+func (h *Handler) chatTools(chat domain.Chat) []aihandler.Tool {
+	var tools []aihandler.Tool
+	for _, tool := range h.allTools(chat) {
+		if !slices.Contains(chat.DisabledTools, tool.Name()) {
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
+
+func (h *Handler) toolNames() []string {
+	var names []string
+	for _, tool := range h.allTools(domain.Chat{}) {
+		names = append(names, tool.Name())
+	}
+	return names
+}
+
+// recordToolCall returns the callback storing tool invocations made while answering the user
+func (h *Handler) recordToolCall(chatID int64, userID int64) func(aihandler.ToolCall) {
+	return func(call aihandler.ToolCall) {
+		record := domain.ToolCall{
+			ChatID:     chatID,
+			UserID:     userID,
+			Tool:       call.Tool,
+			Arguments:  call.Args,
+			Result:     call.Result,
+			DurationMS: call.Duration.Milliseconds(),
+		}
+		if runes := []rune(record.Result); len(runes) > toolResultLogLimit {
+			record.Result = string(runes[:toolResultLogLimit])
+		}
+		if call.Err != nil {
+			record.Error = call.Err.Error()
+		}
+
+		if err := h.db.AddToolCall(record); err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package tghandler
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+const (
+	// approvalPrefix marks the buttons of a new chat notice, adm:<action>:<chat id>
+	approvalPrefix = "adm:"
+	approvalDays   = 30
+)
+
+// SetTrialDays sets how long new chats may use the bot before paying, 0 disables the trial
+func (h *Handler) SetTrialDays(days int) {
+	h.trialDays = days
+}
+
+// registerChat creates the settings of a chat the bot has not seen, with the trial period,
+// and tells the bot admins about it
+func (h *Handler) registerChat(update tgbotapi.Update) {
+	channel := domain.GetDefaultChat()
+
+	channel.ID = update.Message.Chat.ID
+	channel.Type = update.Message.Chat.Type
+	channel.AIModel = h.getCatalog().DefaultText
+	if update.Message.Chat.Type == "private" {
+		channel.ChatName = update.Message.Chat.FirstName + " " + update.Message.Chat.LastName
+	} else {
+		channel.ChatName = update.Message.Chat.Title
+	}
+	channel.BilledTo = time.Now().AddDate(0, 0, h.trialDays)
+
+	err := h.db.CreateChannelConfig(channel)
+	if err != nil {
+		// two first messages at once, the other one registered the chat
+		sentry.CaptureException(err)
+		log.Println(err)
+		h.reloadChannels()
+		return
+	}
+
+	h.reloadChannels()
+	h.notifyNewChat(channel, update.Message.From)
+}
+
+// notifyNewChat sends the new chat to the bot admins with the buttons to decide on it
+func (h *Handler) notifyNewChat(chat domain.Chat, from *tgbotapi.User) {
+	text := "New chat: " + chat.ChatName + " (" + chat.Type + ")" +
+		"\nid: " + strconv.FormatInt(chat.ID, 10)
+	if from != nil {
+		text += "\nby: " + from.FirstName + " " + from.LastName
+		if from.UserName != "" {
+			text += " @" + from.UserName
+		}
+	}
+	if h.trialDays > 0 {
+		text += "\nTrial till " + chat.BilledTo.Format("2006-01-02 15:04")
+	} else {
+		text += "\nNo trial, the bot is silent until the chat is extended"
+	}
+
+	id := strconv.FormatInt(chat.ID, 10)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Approve", approvalPrefix+"approve:"+id),
+			tgbotapi.NewInlineKeyboardButtonData("Extend "+strconv.Itoa(approvalDays)+" days", approvalPrefix+"extend:"+id),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Reject and leave", approvalPrefix+"reject:"+id),
+		),
+	)
+
+	for _, admin := range h.config.Admins {
+		msg := tgbotapi.NewMessage(admin, text)
+		msg.ReplyMarkup = keyboard
+		if _, err := h.bot.Send(msg); err != nil {
+			log.Println("New chat notice to admin", admin, "is not sent:", err)
+		}
+	}
+}
+
+// handleApprovalCallback applies the decision of a bot admin on a new chat
+func (h *Handler) handleApprovalCallback(update tgbotapi.Update) {
+	cb := update.CallbackQuery
+	_, _ = h.bot.Request(tgbotapi.NewCallback(cb.ID, ""))
+
+	if !h.isAdmin(cb.From.ID) {
+		_, _ = h.bot.Request(tgbotapi.NewCallbackWithAlert(cb.ID, "Bot admins only"))
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(cb.Data, approvalPrefix), ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	chatID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return
+	}
+
+	var result string
+	switch parts[0] {
+	case "approve":
+		result = "Approved"
+	case "extend":
+		billedTo, err := h.extendChat(chatID, approvalDays)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+			_, _ = h.bot.Request(tgbotapi.NewCallbackWithAlert(cb.ID, "Failed: "+err.Error()))
+			return
+		}
+		result = "Extended till " + billedTo.Format("2006-01-02 15:04")
+	case "reject":
+		result = h.rejectChat(chatID)
+	default:
+		return
+	}
+
+	// the decision replaces the buttons, so the notice is not handled twice
+	edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID,
+		cb.Message.Text+"\n\n"+result+" by "+cb.From.FirstName)
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Println(err)
+	}
+}
+
+// rejectChat takes the trial back and leaves the chat, the chat is kept so adding the bot again gives no new trial
+func (h *Handler) rejectChat(chatID int64) string {
+	chat, err := h.db.GetChannelConfig(chatID)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return "Rejection failed: " + err.Error()
+	}
+	// ending at creation marks the chat as never paid, it gets no end reminder
+	if err := h.db.SetBilledTo(chat.ID, chat.CreatedAt); err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return "Rejection failed: " + err.Error()
+	}
+	h.reloadChannels()
+
+	if chat.Type == domain.ChatTypePrivate {
+		return "Rejected"
+	}
+	if _, err := h.bot.Request(tgbotapi.LeaveChatConfig{ChatID: chatID}); err != nil {
+		log.Println(err)
+		return "Rejected, leaving failed: " + err.Error()
+	}
+	return "Rejected, left the chat"
+}
@@ -0,0 +1,173 @@
+package tghandler
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+const (
+	defaultUsageDays = 7
+	maxUsageDays     = 90
+	topUsageChats    = 20
+)
+
+// recordUsage returns the callback storing the tokens a request of the user consumed
+func (h *Handler) recordUsage(chatID int64, userID int64) aihandler.UsageFunc {
+	return func(usage aihandler.Usage) {
+		cost := h.usageCost(usage)
+		h.chargeCredits(chatID, cost)
+
+		err := h.db.AddUsage(domain.Usage{
+			ChatID:           chatID,
+			UserID:           userID,
+			AIModel:          usage.Model,
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			CachedTokens:     usage.CachedTokens,
+			Images:           usage.Images,
+			AudioSeconds:     usage.AudioSeconds,
+			Characters:       usage.Characters,
+			Cost:             cost,
+		})
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Println(err)
+		}
+	}
+}
+
+// usageDays reads the period of /usage and /usageAll, false if the argument is broken
+func usageDays(update tgbotapi.Update) (int, bool) {
+	arg := strings.TrimSpace(update.Message.CommandArguments())
+	if arg == "" {
+		return defaultUsageDays, true
+	}
+	days, err := strconv.Atoi(arg)
+	if err != nil || days < 1 || days > maxUsageDays {
+		return 0, false
+	}
+	return days, true
+}
+
+// chatUsage shows the usage of the chat by day and model
+func (h *Handler) chatUsage(update tgbotapi.Update) {
+	if !h.isChatAdmin(update) {
+		return
+	}
+	days, ok := usageDays(update)
+	if !ok {
+		h.sendMessage(update, "invalid period, use /usage <days>, 1 to "+strconv.Itoa(maxUsageDays))
+		return
+	}
+
+	summaries, err := h.db.GetChatUsage(update.Message.Chat.ID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+	if len(summaries) == 0 {
+		h.sendMessage(update, "No usage for the last "+strconv.Itoa(days)+" days")
+		return
+	}
+
+	var total domain.UsageSummary
+	message := "Usage for the last " + strconv.Itoa(days) + " days"
+	var day time.Time
+	for _, summary := range summaries {
+		if !summary.Day.Equal(day) {
+			day = summary.Day
+			message += "\n\n" + day.Format("2006-01-02")
+		}
+		message += "\n" + summary.AIModel + ": " + usageText(summary)
+		addUsage(&total, summary)
+	}
+	message += "\n\nTotal: " + usageText(total)
+
+	h.sendMessage(update, message)
+}
+
+// allUsage shows the chats that used the most tokens, bot admins only
+func (h *Handler) allUsage(update tgbotapi.Update) {
+	if !h.isAdmin(update.Message.From.ID) {
+		h.sendMessage(update, "You are not an admin")
+		return
+	}
+	days, ok := usageDays(update)
+	if !ok {
+		h.sendMessage(update, "invalid period, use /usageAll <days>, 1 to "+strconv.Itoa(maxUsageDays))
+		return
+	}
+
+	summaries, err := h.db.GetTopChatsUsage(time.Now().AddDate(0, 0, -days), topUsageChats)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return
+	}
+	if len(summaries) == 0 {
+		h.sendMessage(update, "No usage for the last "+strconv.Itoa(days)+" days")
+		return
+	}
+
+	message := "Top chats for the last " + strconv.Itoa(days) + " days"
+	for i, summary := range summaries {
+		name := strconv.FormatInt(summary.ChatID, 10)
+		if chat, ok := h.getChat(summary.ChatID); ok {
+			name = chat.ChatName + " (" + name + ")"
+		}
+		message += "\n\n" + strconv.Itoa(i+1) + ". " + name + "\n" + usageText(summary)
+	}
+
+	h.sendMessage(update, message)
+}
+
+func addUsage(total *domain.UsageSummary, summary domain.UsageSummary) {
+	total.Requests += summary.Requests
+	total.PromptTokens += summary.PromptTokens
+	total.CompletionTokens += summary.CompletionTokens
+	total.CachedTokens += summary.CachedTokens
+	total.Images += summary.Images
+	total.AudioSeconds += summary.AudioSeconds
+	total.Characters += summary.Characters
+	total.Cost += summary.Cost
+}
+
+func usageText(summary domain.UsageSummary) string {
+	text := strconv.FormatInt(summary.Requests, 10) + " requests, " +
+		tokensText(summary.PromptTokens) + " in"
+	if summary.CachedTokens > 0 {
+		text += " (" + tokensText(summary.CachedTokens) + " cached)"
+	}
+	text += ", " + tokensText(summary.CompletionTokens) + " out"
+	if summary.Images > 0 {
+		text += ", " + strconv.FormatInt(summary.Images, 10) + " images"
+	}
+	if summary.AudioSeconds > 0 {
+		text += ", " + strconv.FormatInt((summary.AudioSeconds+59)/60, 10) + " min transcribed"
+	}
+	if summary.Characters > 0 {
+		text += ", " + tokensText(summary.Characters) + " chars voiced"
+	}
+	text += ", " + strconv.FormatInt(summary.Cost, 10) + " credits"
+	return text
+}
+
+// tokensText shortens big token counts, 123456 is 123.5k
+func tokensText(tokens int64) string {
+	switch {
+	case tokens >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(tokens)/1_000_000)
+	case tokens >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(tokens)/1_000)
+	}
+	return strconv.FormatInt(tokens, 10)
+}
@@ -4,7 +4,7 @@ import (
 	"crypto/rand"
 	"github.com/getsentry/sentry-go"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
 	"github.com/shabablinchikow/nafanya-bot/internal/domain"
 	"golang.org/x/exp/slices"
 	"log"
@@ -42,14 +42,12 @@ var emotionList = []string{
 func (h *Handler) isItTime(chat int64) bool {
 	defer sentry.Recover()
 
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == chat
-	})
-	if idx == -1 {
+	channel, ok := h.getChat(chat)
+	if !ok {
 		return false
 	}
 
-	if h.chats[idx].Type == domain.ChatTypePrivate {
+	if channel.Type == domain.ChatTypePrivate {
 		return false
 	}
 
@@ -66,8 +64,8 @@ func (h *Handler) isItTime(chat int64) bool {
 		h.chatCache[chat] = newCache
 	}
 
-	agroLevel := int64(h.chats[idx].AgroLevel)
-	cooldown := time.Duration(h.chats[idx].AgroCooldown)
+	agroLevel := int64(channel.AgroLevel)
+	cooldown := time.Duration(channel.AgroCooldown)
 
 	lastRand := h.chatCache[chat].lastRand
 	h.chatCacheMux.Unlock()
@@ -84,7 +82,8 @@ func (h *Handler) isItTime(chat int64) bool {
 }
 
 func (h *Handler) isPersonal(update tgbotapi.Update) bool {
-	if strings.HasPrefix(update.Message.Text, "Нафаня") || strings.HasPrefix(update.Message.Text, "нафаня") || strings.HasPrefix(update.Message.Text, "@grok") {
+	text := messageText(update.Message)
+	if strings.HasPrefix(text, "Нафаня") || strings.HasPrefix(text, "нафаня") || strings.HasPrefix(text, "@grok") {
 		return true
 	} else if update.Message.ReplyToMessage != nil && !h.checkIfURLReply(update) {
 		return update.Message.ReplyToMessage.From.ID == h.bot.Self.ID
@@ -93,11 +92,13 @@ func (h *Handler) isPersonal(update tgbotapi.Update) bool {
 }
 
 func isDraw(update tgbotapi.Update) bool {
-	return strings.Contains(update.Message.Text, "нарисуй") || strings.Contains(update.Message.Text, "Нарисуй")
+	text := messageText(update.Message)
+	return strings.Contains(text, "нарисуй") || strings.Contains(text, "Нарисуй")
 }
 
 func isBanana(update tgbotapi.Update) bool {
-	return strings.Contains(update.Message.Text, "сгенерируй") || strings.Contains(update.Message.Text, "Сгенерируй")
+	text := messageText(update.Message)
+	return strings.Contains(text, "сгенерируй") || strings.Contains(text, "Сгенерируй")
 }
 
 func isDrawAny(update tgbotapi.Update) bool {
@@ -124,25 +125,10 @@ func rollEmotion() string {
 	return emotionList[n]
 }
 
-func (h *Handler) promptCompiler(id int64, promptType int, update tgbotapi.Update, serious bool) (prompt string, userInput string, model string, maxTokens int) {
-	idx := slices.IndexFunc(h.chats, func(channel domain.Chat) bool {
-		return channel.ID == id
-	})
-
-	curChannel := h.chats[idx]
-
-	userInput = update.Message.From.FirstName + " " + update.Message.From.LastName + ": " + update.Message.Text
-
-	nextMess := update.Message.ReplyToMessage
-
-	if nextMess != nil {
-		if !nextMess.From.IsBot {
-			userInput = nextMess.From.FirstName + " " + nextMess.From.LastName + ": " + nextMess.Text + "\n" + userInput
-		} else {
-			userInput = nextMess.From.FirstName + ": " + nextMess.Text + "\n" + userInput
-		}
-	}
+func (h *Handler) promptCompiler(id int64, promptType int, update tgbotapi.Update, serious bool) aihandler.Request {
+	curChannel, _ := h.getChat(id)
 
+	var prompt string
 	switch promptType {
 	case Question:
 		var emotion string
@@ -156,24 +142,84 @@ func (h *Handler) promptCompiler(id int64, promptType int, update tgbotapi.Updat
 		prompt = strings.ReplaceAll(curChannel.RandomInterferencePrompt, "{emotion}", rollEmotion())
 	}
 
-	// Return correct max tokens based on model
-	aiModel := h.chats[idx].AIModel
-	if aiModel == string(cfg.AIModelGemini35) {
+	turns := []aihandler.Turn{{Role: aihandler.RoleSystem, Text: prompt}}
+
+	// the whole thread is restored only for replies to the bot, other replies keep one level
+	threadDepth := 1
+	if update.Message.ReplyToMessage != nil && update.Message.ReplyToMessage.From != nil &&
+		update.Message.ReplyToMessage.From.ID == h.bot.Self.ID {
+		threadDepth = curChannel.ThreadDepth
+	}
+	thread := h.replyChain(curChannel, update.Message, threadDepth)
+
+	exclude := []int{update.Message.MessageID}
+	for _, message := range thread {
+		exclude = append(exclude, message.MessageID)
+	}
+
+	// the thread may be older than the window or inside it, message ids keep them in date order
+	history := append(h.historyWindow(curChannel, exclude...), thread...)
+	slices.SortStableFunc(history, func(a, b domain.ChatMessage) int {
+		return a.MessageID - b.MessageID
+	})
+	for _, message := range history {
+		turns = append(turns, h.historyTurn(message))
+	}
+
+	current := h.messageTurn(update.Message)
+	// images are looked at only when the bot is asked, random interference stays text only
+	if promptType == Question && hasPhoto(update.Message) {
+		current.Images = h.messageImages(update.Message)
+	}
+	// pages behind the links are read only when the bot is asked about them
+	if promptType == Question {
+		current.Text += h.linkContext(curChannel, update.Message, update.Message.ReplyToMessage)
+	}
+	turns = append(turns, current)
+
+	// Return correct max tokens based on model, the catalog limit applies if the bot config has none
+	var maxTokens int
+	aiModel := h.chatModel(curChannel.AIModel)
+	caps, _ := h.ai.Capabilities(aiModel)
+	if caps.Vendor == aihandler.VendorGoogle {
 		maxTokens = h.config.GoogleMaxTokens
 	} else {
 		maxTokens = h.config.OAIMaxTokens
 	}
+	if maxTokens == 0 {
+		maxTokens = caps.MaxTokens
+	}
+
+	var tools []aihandler.Tool
+	if caps.Tools {
+		tools = h.chatTools(curChannel)
+	}
 
-	return prompt, userInput, aiModel, maxTokens
+	var userID int64
+	if update.Message.From != nil {
+		userID = update.Message.From.ID
+	}
+
+	return aihandler.Request{
+		Model:      aiModel,
+		MaxTokens:  maxTokens,
+		Turns:      turns,
+		Tools:      tools,
+		OnToolCall: h.recordToolCall(id, userID),
+		OnUsage:    h.recordUsage(id, userID),
+	}
 }
 
 func (h *Handler) reloadChannels() {
-	var err error
-	h.chats, err = h.db.GetAllChannelsConfig()
+	chats, err := h.db.GetAllChannelsConfig()
 	if err != nil {
 		sentry.CaptureException(err)
 		panic(err)
 	}
+
+	h.chatsMux.Lock()
+	h.chats = chats
+	h.chatsMux.Unlock()
 }
 
 func (h *Handler) sendMessage(update tgbotapi.Update, message string) {
@@ -187,6 +233,78 @@ func (h *Handler) sendMessage(update tgbotapi.Update, message string) {
 	}
 }
 
+// sendAnswer sends the AI answer and keeps it in the chat history.
+// Long answers are split into several messages, or sent as a file if the chat asked for it.
+func (h *Handler) sendAnswer(update tgbotapi.Update, message string) {
+	chat, _ := h.getChat(update.Message.Chat.ID)
+	if chat.AnswerFileThreshold > 0 && len([]rune(message)) > chat.AnswerFileThreshold && h.sendAnswerFile(update, message) {
+		return
+	}
+
+	for _, chunk := range splitMessage(message, chunkLength) {
+		sent, err := h.sendFormatted(update, chunk)
+		if err != nil {
+			return
+		}
+
+		sent.Text = chunk
+		h.rememberMessage(&sent)
+	}
+}
+
+// sendFormatted sends markdown text rendered to telegram HTML,
+// if telegram rejects the markup the text is sent as is
+func (h *Handler) sendFormatted(update tgbotapi.Update, text string) (tgbotapi.Message, error) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, renderMarkdown(text))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyToMessageID = update.Message.MessageID
+
+	sent, err := h.bot.Send(msg)
+	if isEntitiesError(err) {
+		msg.Text = text
+		msg.ParseMode = ""
+		sent, err = h.bot.Send(msg)
+	}
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+	}
+
+	return sent, err
+}
+
+// sendAnswerFile sends the answer as a markdown document, returns false if it failed
+func (h *Handler) sendAnswerFile(update tgbotapi.Update, message string) bool {
+	doc := tgbotapi.NewDocument(update.Message.Chat.ID, tgbotapi.FileBytes{Name: "answer.md", Bytes: []byte(message)})
+	doc.ReplyToMessageID = update.Message.MessageID
+	doc.Caption = answerPreview(message)
+
+	sent, err := h.bot.Send(doc)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return false
+	}
+
+	sent.Text = message
+	h.rememberMessage(&sent)
+
+	return true
+}
+
+// answerPreview returns the beginning of the answer for the document caption
+func answerPreview(message string) string {
+	preview := strings.SplitN(strings.TrimSpace(message), "\n", 2)[0]
+	if runes := []rune(preview); len(runes) > 200 {
+		preview = string(runes[:200]) + "…"
+	}
+	return preview
+}
+
+func isEntitiesError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't parse entities")
+}
+
 func (h *Handler) deleteMessage(update tgbotapi.Update) {
 	msg := tgbotapi.NewDeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
@@ -0,0 +1,172 @@
+package tghandler
+
+import (
+	"log"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/shabablinchikow/nafanya-bot/internal/aihandler"
+	"github.com/shabablinchikow/nafanya-bot/internal/cfg"
+	"github.com/shabablinchikow/nafanya-bot/internal/domain"
+)
+
+const (
+	// maxVoiceDuration in seconds, longer recordings are not transcribed
+	maxVoiceDuration = 300
+
+	transcriptPrefix = "🎤 "
+)
+
+// voiceFile returns the voice note or the audio file of the message, empty fileID if there is none
+func voiceFile(message *tgbotapi.Message) (fileID string, audio aihandler.Audio, duration int) {
+	switch {
+	case message.Voice != nil:
+		return message.Voice.FileID, aihandler.Audio{MIMEType: "audio/ogg", FileName: "voice.ogg"}, message.Voice.Duration
+	case message.Audio != nil:
+		mimeType := message.Audio.MimeType
+		if mimeType == "" {
+			mimeType = "audio/mpeg"
+		}
+		fileName := message.Audio.FileName
+		if fileName == "" {
+			fileName = "audio." + strings.TrimPrefix(mimeType, "audio/")
+		}
+		return message.Audio.FileID, aihandler.Audio{MIMEType: mimeType, FileName: fileName}, message.Audio.Duration
+	}
+	return "", aihandler.Audio{}, 0
+}
+
+func isVoice(message *tgbotapi.Message) bool {
+	fileID, _, _ := voiceFile(message)
+	return fileID != ""
+}
+
+// transcribeMessage puts the transcript of the voice message into its text, so the rest
+// of the bot treats it as a regular message. The caption, if any, goes first.
+func (h *Handler) transcribeMessage(message *tgbotapi.Message) bool {
+	if message == nil || message.Text != "" {
+		return false
+	}
+
+	fileID, audio, duration := voiceFile(message)
+	if fileID == "" || duration > maxVoiceDuration {
+		return false
+	}
+
+	// voice notes are transcribed when they arrive, no need to pay for it twice.
+	// The stored text of a voice note that was not transcribed is only its caption.
+	stored, err := h.db.GetChatMessage(message.Chat.ID, message.MessageID)
+	if err == nil && stored.Transcribed {
+		message.Text = stored.Text
+		return true
+	}
+
+	data, err := h.downloadFile(fileID)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return false
+	}
+	audio.Data = data
+	audio.Duration = duration
+
+	var userID int64
+	if message.From != nil {
+		userID = message.From.ID
+	}
+	ctx, done := h.startGeneration(message.Chat.ID, h.textTimeout)
+	text, err := h.ai.Transcribe(ctx, audio, h.recordUsage(message.Chat.ID, userID))
+	done()
+	if err != nil || text == "" {
+		return false
+	}
+
+	if message.Caption != "" {
+		text = message.Caption + "\n" + text
+	}
+	message.Text = text
+
+	return true
+}
+
+func (h *Handler) autoTranscribe(chatID int64) bool {
+	chat, ok := h.getChat(chatID)
+	return ok && chat.AutoTranscribe
+}
+
+// handleVoice transcribes incoming voice messages, so the ones starting with Нафаня are answered,
+// and posts the transcript in chats with automatic transcripts.
+// Transcription is paid for, so it counts against the request limits.
+func (h *Handler) handleVoice(update tgbotapi.Update) {
+	if !h.withinLimits(update, textRequest) || !h.transcribeMessage(update.Message) {
+		return
+	}
+
+	if h.autoTranscribe(update.Message.Chat.ID) {
+		h.sendMessage(update, transcriptPrefix+update.Message.Text)
+	}
+}
+
+func isSpeak(update tgbotapi.Update) bool {
+	return strings.Contains(update.Message.Text, "скажи голосом") || strings.Contains(update.Message.Text, "Скажи голосом")
+}
+
+// deliverAnswer sends the AI answer as text, voice or both depending on the chat settings.
+// Asking "скажи голосом" gets a voice answer even if the chat has voice replies off.
+func (h *Handler) deliverAnswer(update tgbotapi.Update, answer string, voiceAsked bool) {
+	chat, _ := h.getChat(update.Message.Chat.ID)
+
+	mode := chat.VoiceReplies
+	if voiceAsked && mode != domain.VoiceRepliesBoth {
+		mode = domain.VoiceRepliesVoice
+	}
+
+	switch mode {
+	case domain.VoiceRepliesVoice:
+		if !h.sendVoiceAnswer(update, chat, answer, true) {
+			h.sendAnswer(update, answer)
+		}
+	case domain.VoiceRepliesBoth:
+		h.sendAnswer(update, answer)
+		h.sendVoiceAnswer(update, chat, answer, false)
+	default:
+		h.sendAnswer(update, answer)
+	}
+}
+
+// sendVoiceAnswer voices the answer and sends it as a voice message, returns false if it failed.
+// The spoken text is kept in the chat history if remember is set.
+func (h *Handler) sendVoiceAnswer(update tgbotapi.Update, chat domain.Chat, answer string, remember bool) bool {
+	model := chat.SpeechModel
+	if model == "" {
+		model = string(cfg.DefaultSpeechModel())
+	}
+
+	h.sendAction(update, tgbotapi.ChatRecordVoice)
+	ctx, done := h.startGeneration(update.Message.Chat.ID, h.textTimeout)
+	data, err := h.ai.GetSpeechFromText(ctx, answer, model, h.recordUsage(update.Message.Chat.ID, update.Message.From.ID))
+	done()
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return false
+	}
+
+	voice := tgbotapi.NewVoice(update.Message.Chat.ID, tgbotapi.FileBytes{Name: "voice.ogg", Bytes: data})
+	voice.ReplyToMessageID = update.Message.MessageID
+
+	sent, err := h.bot.Send(voice)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Println(err)
+		return false
+	}
+
+	if remember {
+		sent.Text = answer
+		h.rememberMessage(&sent)
+	}
+
+	return true
+}
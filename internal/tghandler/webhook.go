@@ -0,0 +1,57 @@
+package tghandler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+	// maxUpdateSize limits the webhook request body, updates are a few kilobytes
+	maxUpdateSize = 1 << 20
+)
+
+// SetWebhook makes Telegram post the updates to url with the secret in the header
+func (h *Handler) SetWebhook(url string, secret string, allowedUpdates []string) error {
+	params := tgbotapi.Params{"url": url, "secret_token": secret}
+	if err := params.AddInterface("allowed_updates", allowedUpdates); err != nil {
+		return err
+	}
+	_, err := h.bot.MakeRequest("setWebhook", params)
+	return err
+}
+
+// DeleteWebhook switches Telegram back to long polling, the pending updates are kept for getUpdates
+func (h *Handler) DeleteWebhook() error {
+	_, err := h.bot.Request(tgbotapi.DeleteWebhookConfig{})
+	return err
+}
+
+// Webhook returns the HTTP handler Telegram posts the updates to, requests without the secret are rejected
+func (h *Handler) Webhook(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(secret)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var update tgbotapi.Update
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateSize)).Decode(&update); err != nil {
+			log.Println("Broken webhook update:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// the update is handled in the background, Telegram resends the updates that are answered slowly
+		h.Handle(update)
+		w.WriteHeader(http.StatusOK)
+	})
+}